@@ -0,0 +1,28 @@
+package phash
+
+import (
+	stdimage "image"
+
+	"gocv.io/x/gocv"
+)
+
+// anamorphicName names the aspect-corrected variant.
+const anamorphicName = "anamorphic"
+
+// anamorphicVariant returns the hash of 'img' with its width stretched by
+// Anamorphic, the display aspect correction for anamorphic frames. A
+// squeezed query matches a stored corrected copy through its own variant,
+// and a corrected query matches a stored squeezed copy's variant.
+func (h *PHasher) anamorphicVariant(img gocv.Mat) []Variant {
+	if h.Anamorphic <= 0 || h.Anamorphic == 1 {
+		return nil
+	}
+	width := int(float64(img.Cols())*h.Anamorphic + 0.5)
+	if width < 1 {
+		width = 1
+	}
+	corrected := gocv.NewMat()
+	defer corrected.Close()
+	gocv.Resize(img, &corrected, stdimage.Pt(width, img.Rows()), 0, 0, gocv.InterpolationArea)
+	return []Variant{{Name: anamorphicName, Hash: h.hashMat(corrected)}}
+}
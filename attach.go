@@ -0,0 +1,239 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// maxAttached is the number of DBs attached per connection by AttachedStore,
+// SQLite's default limit.
+const maxAttached = 10
+
+// attachGroup is a connection with up to maxAttached DBs attached.
+type attachGroup struct {
+	mu      sync.Mutex
+	db      *sql.DB
+	conn    *sql.Conn
+	aliases []string
+	// number of hash word columns of the attached tables, detected on the
+	// first lookup
+	words int
+}
+
+// AttachedStore is a Store that looks up hashes across several SQLite DB
+// files at once, by attaching them to a connection and querying them with
+// UNION ALL. Since SQLite limits the number of attached DBs, files are
+// attached in groups of maxAttached, with one query per group. Inserts and
+// Init go to Primary, if set.
+type AttachedStore struct {
+	// Primary, if set, receives inserts.
+	Primary *SQLiteStore
+	// Variants includes each DB's 'key_hash_variants' table in lookups.
+	Variants bool
+	// Metric is used to compute distances for fuzzy lookups.
+	Metric DistanceMetric
+	// Table is the hash table in each DB, 'key_hashes' if empty. It must be
+	// a valid table name.
+	Table string
+
+	groups []*attachGroup
+}
+
+// NewAttachedStore attaches 'files', opening a connection for each group of
+// them with 'open'.
+func NewAttachedStore(files []string, open func(file string) (*sql.DB, error)) (*AttachedStore, error) {
+	s := &AttachedStore{}
+	ctx := context.Background()
+	for i := 0; i < len(files); i += maxAttached {
+		group := files[i:]
+		if len(group) > maxAttached {
+			group = group[:maxAttached]
+		}
+		db, err := open(":memory:")
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		g := &attachGroup{db: db}
+		s.groups = append(s.groups, g)
+		// ATTACH only applies to one connection, so keep it.
+		if g.conn, err = db.Conn(ctx); err != nil {
+			s.Close()
+			return nil, err
+		}
+		for j, file := range group {
+			alias := fmt.Sprintf("lookup%d", j)
+			if _, err := g.conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+alias, file); err != nil {
+				s.Close()
+				return nil, fmt.Errorf("attaching %q: %v", file, err)
+			}
+			g.aliases = append(g.aliases, alias)
+		}
+	}
+	return s, nil
+}
+
+// Init initializes Primary.
+func (s *AttachedStore) Init() error {
+	if s.Primary == nil {
+		return nil
+	}
+	return s.Primary.Init()
+}
+
+// Insert stores 'results' in Primary.
+func (s *AttachedStore) Insert(results []Result) (int, error) {
+	if s.Primary == nil {
+		return 0, errors.New("no primary DB to insert into")
+	}
+	return s.Primary.Insert(results)
+}
+
+// union returns 'query', which selects from "%[1]s.table", UNION ALLed
+// across 'aliases'.
+func union(query string, aliases []string) string {
+	parts := make([]string, len(aliases))
+	for i, alias := range aliases {
+		parts[i] = fmt.Sprintf(query, alias)
+	}
+	return strings.Join(parts, " UNION ALL ")
+}
+
+// Lookup returns matching frames from every attached DB.
+func (s *AttachedStore) Lookup(ctx context.Context, hash []byte, maxDist int) ([]Match, error) {
+	if err := checkHashLen(hash); err != nil {
+		return nil, err
+	}
+	tables := []string{tableQuery(defaultTable, s.Table)}
+	if s.Variants {
+		tables = append(tables, tableQuery("key_hash_variants", s.Table))
+	}
+	var matches []Match
+	for _, g := range s.groups {
+		words, err := g.hashWords(ctx, s.Table)
+		if err != nil {
+			return nil, err
+		}
+		un := unpackWords(hash, words)
+		for _, table := range tables {
+			var query string
+			var args []interface{}
+			if maxDist <= 0 {
+				query = union(hashQuery("select fullpath, frame, h1, h2, h3, h4 from %[1]s."+table+" where h1 = ? and h2 = ? and h3 = ? and h4 = ?", words), g.aliases)
+				for range g.aliases {
+					args = append(args, wordArgs(un)...)
+				}
+			} else {
+				query = union(hashQuery("select fullpath, frame, h1, h2, h3, h4 from %[1]s."+table, words), g.aliases)
+			}
+			found, err := g.lookup(ctx, query, args, hash, words, s.Metric, maxDist)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, found...)
+		}
+	}
+	return mergeMatches(nil, matches), nil
+}
+
+// hashWordsQuery selects the columns of a table in an attached DB.
+const hashWordsQuery = "select name from pragma_table_info(?, ?)"
+
+// hashWords returns the number of hash word columns of hash table 'table'
+// in the group's DBs, detecting it on first use. DBs without the table are
+// ignored; DBs with different numbers of columns can't be queried together.
+func (g *attachGroup) hashWords(ctx context.Context, table string) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.words > 0 {
+		return g.words, nil
+	}
+	words := 0
+	for _, alias := range g.aliases {
+		rows, err := g.conn.QueryContext(ctx, hashWordsQuery, tableQuery(defaultTable, table), alias)
+		if err != nil {
+			return 0, err
+		}
+		columns := 0
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if hashColumnRe.MatchString(name) {
+				columns++
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		if columns > 0 && words > 0 && columns != words {
+			return 0, fmt.Errorf("attached DBs have %d and %d hash columns", words, columns)
+		}
+		if columns > 0 {
+			words = columns
+		}
+	}
+	if words == 0 {
+		words = hashWords(runtimeHashLen())
+	}
+	g.words = words
+	return words, nil
+}
+
+// lookup runs 'query', returning the rows within 'maxDist' of 'hash', whose
+// first 'words' words it selects.
+func (g *attachGroup) lookup(ctx context.Context, query string, args []interface{}, hash []byte, words int, metric DistanceMetric, maxDist int) ([]Match, error) {
+	un := unpackWords(hash, words)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rows, err := g.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []Match
+	stored := make([]uint32, words)
+	nulls := 0
+	defer func() { logNullRows(nulls) }()
+	for rows.Next() {
+		var row hashRow
+		if err := rows.Scan(row.dest(words)...); err != nil {
+			return nil, err
+		}
+		if !row.valid() {
+			nulls++
+			continue
+		}
+		m := row.match(stored)
+		m.Distance, err = metricDistance(metric, hash, un, stored)
+		if err != nil {
+			return nil, err
+		}
+		if m.Distance <= maxDist {
+			matches = append(matches, m)
+		}
+	}
+	return matches, rows.Err()
+}
+
+// Close closes the attached DBs' connections.
+func (s *AttachedStore) Close() error {
+	var err error
+	for _, g := range s.groups {
+		if g.conn != nil {
+			g.conn.Close()
+		}
+		if cerr := g.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.groups = nil
+	return err
+}
@@ -0,0 +1,87 @@
+package phash
+
+// bkEntry is a hash stored in a bkTree.
+type bkEntry struct {
+	hash     []byte
+	key      string
+	frame    int
+	path     string
+	metadata map[string]string
+	// variant is set for variant hashes of a frame.
+	variant bool
+}
+
+// bkNode is a node in a bkTree. Children are indexed by their distance from
+// the node's entry.
+type bkNode struct {
+	entry    bkEntry
+	children map[int]*bkNode
+}
+
+// bkTree is an in-memory BK-tree over Hamming distance, supporting fast
+// lookups of all hashes within a distance of a query.
+type bkTree struct {
+	root *bkNode
+	size int
+}
+
+// add inserts an entry into the tree.
+func (t *bkTree) add(e bkEntry) {
+	t.size++
+	if t.root == nil {
+		t.root = &bkNode{entry: e}
+		return
+	}
+	n := t.root
+	for {
+		d := HammingDistance(n.entry.hash, e.hash)
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*bkNode)
+			}
+			n.children[d] = &bkNode{entry: e}
+			return
+		}
+		n = child
+	}
+}
+
+// walk calls 'f' with each entry, parents before children.
+func (t *bkTree) walk(f func(e bkEntry)) {
+	if t.root == nil {
+		return
+	}
+	queue := []*bkNode{t.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		f(n.entry)
+		for _, child := range n.children {
+			queue = append(queue, child)
+		}
+	}
+}
+
+// lookup calls 'f' for each entry within 'maxDist' of 'hash'.
+func (t *bkTree) lookup(hash []byte, maxDist int, f func(e bkEntry, dist int)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := HammingDistance(n.entry.hash, hash)
+		if d <= maxDist {
+			f(n.entry, d)
+		}
+		// By the triangle inequality, matches can only be under children
+		// whose distance from this node is within maxDist of d.
+		for cd, child := range n.children {
+			if cd >= d-maxDist && cd <= d+maxDist {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
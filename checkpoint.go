@@ -0,0 +1,96 @@
+package phash
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// checkpoint records the frames committed by store runs in Checkpoint, so a
+// restarted run can skip them without reading or hashing them again. Each
+// line of the file is "frame<TAB>path".
+type checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[checkpointEntry]bool
+}
+
+type checkpointEntry struct {
+	path  string
+	frame int
+}
+
+// openCheckpoint reads the frames recorded in Checkpoint, if set, and opens
+// it for appending. It returns nil if Checkpoint is unset.
+func (h *PHasher) openCheckpoint() (*checkpoint, error) {
+	if h.Checkpoint == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(h.Checkpoint, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{f: f, done: make(map[checkpointEntry]bool)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		i := strings.Index(text, "\t")
+		if i < 0 {
+			// A line cut short by a crash; the frame is simply redone.
+			continue
+		}
+		frame, err := strconv.Atoi(text[:i])
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: bad frame %q", h.Checkpoint, line, text[:i])
+		}
+		cp.done[checkpointEntry{text[i+1:], frame}] = true
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(cp.done) > 0 {
+		h.infof("resuming from checkpoint %q: %d frames already stored", h.Checkpoint, len(cp.done))
+	}
+	return cp, nil
+}
+
+// has reports whether frame 'frame' of 'path' was committed by an earlier
+// run. A nil checkpoint has nothing.
+func (cp *checkpoint) has(path string, frame int) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.done[checkpointEntry{path, frame}]
+}
+
+// record appends committed images to the checkpoint file and syncs it.
+func (cp *checkpoint) record(imgs []*image) error {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	var b strings.Builder
+	for _, img := range imgs {
+		fmt.Fprintf(&b, "%d\t%s\n", img.frame, img.path)
+		cp.done[checkpointEntry{img.path, img.frame}] = true
+	}
+	if _, err := cp.f.WriteString(b.String()); err != nil {
+		return err
+	}
+	return cp.f.Sync()
+}
+
+func (cp *checkpoint) close() error {
+	if cp == nil {
+		return nil
+	}
+	return cp.f.Close()
+}
@@ -0,0 +1,62 @@
+package phash
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Compare hashes images in 'dirA' into an in-memory Matcher and returns the frames
+// from it within Hamming distance 'maxDist' of each image in 'dirB'. No DB is
+// used. Each Match's Query is the path of the image from dirB, and Key,
+// Frame, and Path describe the image from dirA. Matches are sorted by query
+// path, then distance.
+func (h *PHasher) Compare(dirA, dirB []string, maxDist int) ([]Match, error) {
+	if maxDist < 0 {
+		return nil, errors.New("maxDist must not be negative")
+	}
+	if err := CheckHashSupport(); err != nil {
+		return nil, err
+	}
+	index := NewMatcher(NewMemStore())
+	h.runPipeline(dirA, func(dbC chan *image, wg *sync.WaitGroup, stats *runStats) {
+		defer wg.Done()
+		for img := range dbC {
+			index.add(img.result())
+		}
+		n, _ := index.flush()
+		atomic.AddInt64(&stats.stored, int64(n))
+	})
+
+	var matches []Match
+	h.runPipeline(dirB, func(dbC chan *image, wg *sync.WaitGroup, stats *runStats) {
+		defer wg.Done()
+		for img := range dbC {
+			found, err := index.Query(img.hash, maxDist)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			for _, m := range found {
+				m.Query = img.path
+				matches = append(matches, m)
+			}
+			atomic.AddInt64(&stats.queried, 1)
+			atomic.AddInt64(&stats.matches, int64(len(found)))
+		}
+	})
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Query != b.Query {
+			return a.Query < b.Query
+		}
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		return a.Path < b.Path
+	})
+	return matches, nil
+}
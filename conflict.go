@@ -0,0 +1,96 @@
+package phash
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConflictPolicy selects what SQLiteStore.Insert does with a frame whose
+// (key, frame) is already stored with a different hash.
+type ConflictPolicy int
+
+const (
+	// ConflictIgnore keeps the stored row. This is the default.
+	ConflictIgnore ConflictPolicy = iota
+	// ConflictUpdate replaces the stored hash, variants, thumbnail, content
+	// hash, and metadata with the new ones. Stored variants the new frame
+	// doesn't have are dropped.
+	ConflictUpdate
+	// ConflictError fails the batch with ErrConflict.
+	ConflictError
+)
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictIgnore: "ignore",
+	ConflictUpdate: "update",
+	ConflictError:  "error",
+}
+
+func (p ConflictPolicy) String() string {
+	if s, ok := conflictPolicyNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+}
+
+// ParseConflictPolicy converts a policy name ("ignore", "update", "error")
+// to a ConflictPolicy.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for p, name := range conflictPolicyNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return ConflictIgnore, fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// ErrConflict is returned under ConflictError when a stored frame's hash
+// differs from the one being stored.
+var ErrConflict = errors.New("frame already stored with a different hash")
+
+const storedHashQuery = "select h1, h2, h3, h4 from key_hashes where fullpath = ? and frame = ?"
+const deleteFrameVariantsQuery = "DELETE FROM key_hash_variants where fullpath = ? and frame = ?"
+
+// resolveConflict handles a frame that couldn't be inserted into
+// 'key_hashes' because 'r's (key, frame) is already stored, according to
+// Conflict. It returns whether the stored hash was replaced, in which case
+// the frame's stored variants are deleted, to be replaced by 'r's.
+func (s *SQLiteStore) resolveConflict(tx *sql.Tx, r Result, un []uint32) (bool, error) {
+	if s.Conflict == ConflictIgnore {
+		return false, nil
+	}
+	stored := make([]uint32, len(un))
+	if err := tx.QueryRow(s.tableQuery(storedHashQuery), r.Key, r.Frame).Scan(wordDest(stored)...); err != nil {
+		return false, err
+	}
+	same := true
+	for i := range stored {
+		same = same && stored[i] == un[i]
+	}
+	switch {
+	case same:
+		return false, nil
+	case s.Conflict == ConflictError:
+		return false, fmt.Errorf("%v: key %q frame %d", ErrConflict, r.Key, r.Frame)
+	}
+	if _, err := tx.Exec(s.tableQuery(updateHashQuery), wordArgs(un, r.Key, r.Frame)...); err != nil {
+		return false, err
+	}
+	// Variants of the old hash, e.g. from a run with other Tiles or Scales,
+	// don't describe the new one.
+	if _, err := tx.Exec(s.tableQuery(deleteFrameVariantsQuery), r.Key, r.Frame); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// insertQuery returns insert query 'q' for a per-frame table, replacing
+// existing rows under ConflictUpdate.
+func (s *SQLiteStore) insertQuery(q string) string {
+	if s.Conflict != ConflictUpdate {
+		return q
+	}
+	return strings.Replace(q, "INSERT INTO", "INSERT OR REPLACE INTO", 1)
+}
@@ -0,0 +1,58 @@
+package phash
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestConflictUpdateReplacesVariants(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := testDB(t, Result{Key: "a", Frame: 1, Hash: testHash(1), Variants: []Variant{{Name: "tile0", Hash: testHash(2)}}})
+	h.Conflict = ConflictUpdate
+	h.Orientations = true
+	st, release, err := h.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := st.Insert([]Result{{Key: "a", Frame: 1, Hash: testHash(3), Variants: []Variant{{Name: "flip", Hash: testHash(4)}}}}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{0, 0, 1, 1} {
+		matches, err := st.Lookup(context.Background(), testHash(i+1), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != want {
+			t.Errorf("hash %d: got matches %+v, want %d", i+1, matches, want)
+		}
+	}
+	if got := tableRows(t, h.DBFile, "key_hash_variants"); !reflect.DeepEqual(got, []string{"a 1"}) {
+		t.Errorf("got variant rows %q, want one", got)
+	}
+}
+
+func TestConflictIgnoreKeepsMetadata(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := testDB(t, Result{Key: "a", Frame: 1, Hash: testHash(1), Metadata: map[string]string{"src": "old"}})
+	st, release, err := h.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := st.Insert([]Result{{Key: "a", Frame: 1, Hash: testHash(2), Metadata: map[string]string{"src": "new"}}}); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := st.Lookup(context.Background(), testHash(1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Metadata["src"] != "old" {
+		t.Errorf("got matches %+v, want frame a 1 with its old metadata", matches)
+	}
+}
@@ -0,0 +1,44 @@
+package phash
+
+import "strings"
+
+// createContentHashesQuery creates the 'content_hashes' table used by InitDB.
+// Rows hold the hex SHA-256 of each stored frame's file.
+const createContentHashesQuery = "CREATE TABLE IF NOT EXISTS content_hashes(fullpath text, frame integer, sha256 text, UNIQUE(fullpath, frame))"
+const insertContentHashQuery = "INSERT INTO content_hashes(fullpath, frame, sha256) values(?,?,?)"
+const scanContentHashesQuery = "select fullpath, frame, sha256 from content_hashes"
+const identicalFramesQuery = "select c.fullpath, c.frame, c.sha256 from content_hashes c join (select sha256 from content_hashes group by sha256 having count(*) > 1) d on c.sha256 = d.sha256 order by c.sha256, c.fullpath, c.frame"
+
+// IdenticalFrames returns groups of stored frames whose files are
+// byte-identical, according to the content hashes stored with
+// StoreContentHashes. A DB without content hashes has none.
+func (h *PHasher) IdenticalFrames() ([][]FrameRef, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(identicalFramesQuery)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result [][]FrameRef
+	last := ""
+	for rows.Next() {
+		var f FrameRef
+		var sum string
+		if err := rows.Scan(&f.Key, &f.Frame, &sum); err != nil {
+			return nil, err
+		}
+		if sum != last || result == nil {
+			result = append(result, nil)
+			last = sum
+		}
+		result[len(result)-1] = append(result[len(result)-1], f)
+	}
+	return result, rows.Err()
+}
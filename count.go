@@ -0,0 +1,99 @@
+package phash
+
+import "context"
+
+const countExactQuery = "select count(*) from key_hashes where h1 = ? and h2 = ? and h3 = ? and h4 = ?"
+
+// counter is implemented by Stores that can count matches without returning
+// them.
+type counter interface {
+	Count(ctx context.Context, hash []byte, maxDist, limit int) (int, error)
+}
+
+// CountMatches returns the number of stored frames whose hash is within
+// Hamming distance 'maxDist' of 'hash'. A maxDist of 0 counts exact matches.
+func (h *PHasher) CountMatches(hash []byte, maxDist int) (int, error) {
+	return h.countMatches(hash, maxDist, 0)
+}
+
+// Exists reports whether any stored frame's hash is within Hamming distance
+// 'maxDist' of 'hash'. Fuzzy checks stop at the first match.
+func (h *PHasher) Exists(hash []byte, maxDist int) (bool, error) {
+	n, err := h.countMatches(hash, maxDist, 1)
+	return n > 0, err
+}
+
+// countMatches counts matches as in CountMatches, stopping once 'limit'
+// matches are found if limit is positive. It uses the store held by
+// OpenHasher, if any, and its prepared statements.
+func (h *PHasher) countMatches(hash []byte, maxDist, limit int) (int, error) {
+	if err := checkHashLen(hash); err != nil {
+		return 0, err
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	ctx := context.Background()
+	if c, ok := st.(counter); ok {
+		return c.Count(ctx, hash, maxDist, limit)
+	}
+	matches, err := st.Lookup(ctx, hash, maxDist)
+	if limit > 0 && len(matches) > limit {
+		return limit, err
+	}
+	return len(matches), err
+}
+
+// Count returns the number of frames in 'key_hashes' whose hash is within
+// distance 'maxDist' of 'hash' under Metric, stopping once 'limit' are found
+// if limit is positive. Variants and rows with NULLs aren't counted.
+func (s *SQLiteStore) Count(ctx context.Context, hash []byte, maxDist, limit int) (int, error) {
+	un := s.unpack(hash)
+	if maxDist <= 0 {
+		stmt, err := s.stmt(ctx, s.tableQuery(countExactQuery))
+		if err != nil {
+			return 0, err
+		}
+		var count int
+		err = stmt.QueryRowContext(ctx, wordArgs(un)...).Scan(&count)
+		return count, err
+	}
+
+	stmt, err := s.stmt(ctx, s.tableQuery(scanAllHashesQuery))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	nulls := 0
+	defer func() { logNullRows(nulls) }()
+	stored := make([]uint32, len(un))
+	for rows.Next() {
+		var row hashRow
+		if err := rows.Scan(row.dest(len(un))...); err != nil {
+			return count, err
+		}
+		if !row.valid() {
+			nulls++
+			continue
+		}
+		row.match(stored)
+		dist, err := metricDistance(s.Metric, hash, un, stored)
+		if err != nil {
+			return count, err
+		}
+		if dist <= maxDist {
+			count++
+			if limit > 0 && count >= limit {
+				return count, nil
+			}
+		}
+	}
+	return count, rows.Err()
+}
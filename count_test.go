@@ -0,0 +1,72 @@
+package phash
+
+import "testing"
+
+func TestCountMatches(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	hash := testHash(1)
+	setup := testDB(t,
+		Result{Key: "a", Frame: 1, Hash: hash},
+		Result{Key: "a", Frame: 2, Hash: hash},
+		Result{Key: "b", Frame: 1, Hash: flipBit(hash, 0)},
+		Result{Key: "c", Frame: 1, Hash: testHash(2)},
+	)
+	h, err := OpenHasher(setup.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, tt := range []struct {
+		maxDist, want int
+	}{{0, 2}, {1, 3}} {
+		n, err := h.CountMatches(hash, tt.maxDist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.want {
+			t.Errorf("maxdist %d: got %d matches, want %d", tt.maxDist, n, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		hash []byte
+		want bool
+	}{{flipBit(hash, 1), true}, {flipBit(flipBit(hash, 1), 2), false}} {
+		ok, err := h.Exists(tt.hash, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("Exists: got %v, want %v", ok, tt.want)
+		}
+	}
+}
+
+func TestCountMatchesSkipsNullRows(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	hash := testHash(1)
+	setup := testDB(t, Result{Key: "a", Frame: 1, Hash: hash})
+	db, err := setup.openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO key_hashes(fullpath, frame, h1) values('b', 1, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	h, err := OpenHasher(setup.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	n, err := h.CountMatches(hash, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d matches, want 1", n)
+	}
+}
@@ -0,0 +1,44 @@
+package phash
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// openDB opens DBFile with the configured connection pragmas. Pragmas are
+// passed as go-sqlite3 DSN parameters so that they apply to every connection
+// in the pool, not just the first.
+func (h *PHasher) openDB() (*sql.DB, error) {
+	return h.openDBFile(h.DBFile)
+}
+
+// openDBFile opens 'file' as in openDB.
+func (h *PHasher) openDBFile(file string) (*sql.DB, error) {
+	if err := checkTableName(h.Table); err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	if h.Synchronous != "" {
+		switch strings.ToUpper(h.Synchronous) {
+		case "OFF", "NORMAL", "FULL", "EXTRA":
+		default:
+			return nil, fmt.Errorf("invalid synchronous mode %q", h.Synchronous)
+		}
+		params.Set("_sync", strings.ToUpper(h.Synchronous))
+	}
+	if h.CacheSize != 0 {
+		params.Set("_cache_size", strconv.Itoa(h.CacheSize))
+	}
+	dsn := file
+	if len(params) > 0 {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + params.Encode()
+	}
+	return sql.Open("sqlite3", dsn)
+}
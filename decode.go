@@ -0,0 +1,124 @@
+package phash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// pngMagic is the signature at the start of every PNG file.
+var pngMagic = []byte("\x89PNG\r\n\x1a\n")
+
+// readImage reads the image at 'p' as grayscale. PNGs with an alpha channel
+// are flattened onto AlphaBackground first so that transparent regions hash
+// deterministically rather than depending on how the decoder composites
+// alpha. Files that can't be opened, e.g. for lack of file descriptors, are
+// logged as such.
+func (h *PHasher) readImage(p string) gocv.Mat {
+	isPNG := strings.ToLower(path.Ext(p)) == ".png"
+	img := h.decode(p, isPNG, func(flags gocv.IMReadFlag) gocv.Mat {
+		return gocv.IMRead(p, flags)
+	})
+	if img.Empty() {
+		// IMRead doesn't say why it failed.
+		if f, err := os.Open(p); err != nil {
+			log.Print(fileLimitErr(err))
+		} else {
+			f.Close()
+		}
+	}
+	return img
+}
+
+// readImageContent reads the image at 'p' like readImage, also returning the
+// SHA-256 of the file's bytes. The file is only read once.
+func (h *PHasher) readImageContent(p string) (gocv.Mat, []byte) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		log.Print(fileLimitErr(err))
+		return gocv.NewMat(), nil
+	}
+	sum := sha256.Sum256(data)
+	return h.decodeNamed(p, data), sum[:]
+}
+
+// decodeImage decodes an encoded image as grayscale, handling alpha the same
+// way as readImage.
+func (h *PHasher) decodeImage(data []byte) gocv.Mat {
+	return h.decodeNamed("<bytes>", data)
+}
+
+// decodeNamed decodes an encoded image named 'name' as in decodeImage.
+func (h *PHasher) decodeNamed(name string, data []byte) gocv.Mat {
+	isPNG := bytes.HasPrefix(data, pngMagic)
+	return h.decode(name, isPNG, func(flags gocv.IMReadFlag) gocv.Mat {
+		img, err := gocv.IMDecode(data, flags)
+		if err != nil {
+			log.Print(err)
+			return gocv.NewMat()
+		}
+		return img
+	})
+}
+
+// decode reads an image named 'name' via 'read' as grayscale.
+func (h *PHasher) decode(name string, isPNG bool, read func(gocv.IMReadFlag) gocv.Mat) gocv.Mat {
+	if !isPNG {
+		return h.readGray(read)
+	}
+	img := read(gocv.IMReadUnchanged)
+	if img.Empty() || img.Type() != gocv.MatTypeCV8UC4 {
+		img.Close()
+		return h.readGray(read)
+	}
+	defer img.Close()
+	flat, err := flattenAlpha(img, h.AlphaBackground)
+	if err != nil {
+		log.Printf("failed to flatten alpha in %q: %v", name, err)
+		return gocv.NewMat()
+	}
+	flat = h.reduceMat(flat)
+	defer flat.Close()
+	return h.toGray(flat)
+}
+
+// readGray reads an image via 'read' as grayscale according to Grayscale.
+func (h *PHasher) readGray(read func(gocv.IMReadFlag) gocv.Mat) gocv.Mat {
+	if h.Grayscale == GrayLuma {
+		return read(h.readFlag(true))
+	}
+	img := read(h.readFlag(false))
+	defer img.Close()
+	if img.Empty() {
+		return gocv.NewMat()
+	}
+	return h.toGray(img)
+}
+
+// flattenAlpha composites an 8-bit BGRA image onto a solid background color,
+// returning an 8-bit BGR image. A nil background is treated as black.
+func flattenAlpha(img gocv.Mat, background color.Color) (gocv.Mat, error) {
+	var bg [3]uint32 // BGR
+	if background != nil {
+		r, g, b, _ := background.RGBA()
+		bg = [3]uint32{b >> 8, g >> 8, r >> 8}
+	}
+	src := img.ToBytes()
+	n := img.Rows() * img.Cols()
+	dst := make([]byte, n*3)
+	for i := 0; i < n; i++ {
+		a := uint32(src[i*4+3])
+		for c := 0; c < 3; c++ {
+			v := uint32(src[i*4+c])*a + bg[c]*(255-a)
+			dst[i*3+c] = byte((v + 127) / 255)
+		}
+	}
+	return gocv.NewMatFromBytes(img.Rows(), img.Cols(), gocv.MatTypeCV8UC3, dst)
+}
@@ -0,0 +1,131 @@
+package phash
+
+import (
+	"database/sql"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// Duplicate is a pair of stored frames whose hashes are within a Hamming
+// distance of each other.
+type Duplicate struct {
+	KeyA     string
+	FrameA   int
+	KeyB     string
+	FrameB   int
+	Distance int
+	// Identical is set if both frames' files have the same stored content
+	// hash, i.e. they're byte-identical rather than just similar.
+	Identical bool
+}
+
+// dedupEntry is a stored frame considered by FindDuplicates.
+type dedupEntry struct {
+	key   string
+	frame int
+	hash  []uint32
+}
+
+// FindDuplicates returns all pairs of stored frames whose hashes are within
+// Hamming distance 'maxDist' of each other.
+//
+// To avoid comparing every pair, frames are bucketed by the top 8 bits of
+// their hash. The distance between two hashes is at least the distance
+// between their top 8 bits, so two buckets are only compared if their
+// prefixes differ in at most maxDist bits. This prunes most pairs for small
+// maxDist; for maxDist >= 8 every pair is compared.
+func (h *PHasher) FindDuplicates(maxDist int) ([]Duplicate, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(st.tableQuery(scanAllHashesQuery))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buckets [256][]dedupEntry
+	for rows.Next() {
+		e := dedupEntry{hash: make([]uint32, st.hashWords())}
+		if err := rows.Scan(append([]interface{}{&e.key, &e.frame}, wordDest(e.hash)...)...); err != nil {
+			return nil, err
+		}
+		b := e.hash[0] >> 24
+		buckets[b] = append(buckets[b], e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	content, err := contentHashes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Duplicate
+	compare := func(a, b *dedupEntry) {
+		if d := wordDistance(a.hash, b.hash); d <= maxDist {
+			ca, ok := content[frameID{a.key, a.frame}]
+			identical := ok && ca == content[frameID{b.key, b.frame}]
+			result = append(result, Duplicate{a.key, a.frame, b.key, b.frame, d, identical})
+		}
+	}
+	for i := range buckets {
+		bi := buckets[i]
+		for x := range bi {
+			for y := x + 1; y < len(bi); y++ {
+				compare(&bi[x], &bi[y])
+			}
+		}
+		for j := i + 1; j < len(buckets); j++ {
+			if bits.OnesCount8(uint8(i^j)) > maxDist {
+				continue
+			}
+			bj := buckets[j]
+			for x := range bi {
+				for y := range bj {
+					compare(&bi[x], &bj[y])
+				}
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if a.KeyA != b.KeyA {
+			return a.KeyA < b.KeyA
+		}
+		return a.FrameA < b.FrameA
+	})
+	return result, nil
+}
+
+// contentHashes returns the stored content hash of each frame, if any.
+func contentHashes(db *sql.DB) (map[frameID]string, error) {
+	rows, err := db.Query(scanContentHashesQuery)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[frameID]string)
+	for rows.Next() {
+		var id frameID
+		var sum string
+		if err := rows.Scan(&id.key, &id.frame, &sum); err != nil {
+			return nil, err
+		}
+		result[id] = sum
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,41 @@
+package phash
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"gocv.io/x/gocv"
+)
+
+// hashesRepeat reports whether hashing 'img' a second time gives img.hash,
+// logging a warning and counting the image as nondeterministic if not.
+// Image files, and fetched objects, are decoded again, so nondeterministic
+// decodes are caught too; frames of multi-frame files are only hashed again
+// from 'prepared'.
+func (h *PHasher) hashesRepeat(img *image, prepared gocv.Mat, stats *runStats) bool {
+	again := prepared
+	if img.encoded != nil || !isMultiFrame(img.path) {
+		var reread gocv.Mat
+		if img.encoded != nil {
+			reread = h.decodeNamed(img.path, img.encoded)
+			img.encoded = nil
+		} else {
+			reread = h.readImage(img.path)
+		}
+		defer reread.Close()
+		p, err := h.prepareImage(reread)
+		defer p.Close()
+		if err != nil {
+			h.infof("warning: %q: hashed once but not again: %v", img.path, err)
+			atomic.AddInt64(&stats.nondeterministic, 1)
+			return false
+		}
+		again = p
+	}
+	if hash := h.hashMat(again); !bytes.Equal(hash, img.hash) {
+		h.infof("warning: %q hashes nondeterministically: %x then %x", img.path, img.hash, hash)
+		atomic.AddInt64(&stats.nondeterministic, 1)
+		return false
+	}
+	return true
+}
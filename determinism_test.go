@@ -0,0 +1,43 @@
+package phash
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func TestDeterministicDropsNondeterministicImages(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	const frames = 8
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for _, dir := range dirs {
+		writeFrames(t, dir, frames/2)
+	}
+	// With one hash proc, each image is preprocessed twice in a row; flip
+	// the second copy of every other image.
+	var calls int64
+	h := testDB(t)
+	h.DBTimeout = 30 * time.Second
+	h.HashProcs = 1
+	h.Deterministic = true
+	h.CheckDeterminism = true
+	h.Preprocess = func(img gocv.Mat) (gocv.Mat, error) {
+		if atomic.AddInt64(&calls, 1)%4 != 2 {
+			return img, nil
+		}
+		flipped := gocv.NewMat()
+		gocv.Flip(img, &flipped, 1)
+		return flipped, nil
+	}
+	summary := h.StoreHashesFromDirs(dirs)
+	if summary.Nondeterministic != frames/2 || summary.Stored != frames/2 {
+		t.Errorf("stored %d frames with %d nondeterministic, want %d of each", summary.Stored, summary.Nondeterministic, frames/2)
+	}
+	if rows := hashRows(t, h.DBFile); len(rows) != frames/2 {
+		t.Errorf("got %d rows, want %d", len(rows), frames/2)
+	}
+}
@@ -0,0 +1,120 @@
+package phash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"gocv.io/x/gocv"
+	cv_contrib "gocv.io/x/gocv/contrib"
+)
+
+// HammingDistance returns the number of differing bits between two hashes.
+// If the hashes differ in length, the extra bytes of the longer one count as
+// differing in every set bit.
+func HammingDistance(a, b []byte) int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	d := 0
+	for i := range b {
+		d += bits.OnesCount8(a[i] ^ b[i])
+	}
+	for _, x := range a[len(b):] {
+		d += bits.OnesCount8(x)
+	}
+	return d
+}
+
+// Similarity returns the fraction of bits that agree between 'a' and 'b',
+// from 0 to 1, out of the bits of the longer hash as in HammingDistance. Two
+// empty hashes are identical.
+func Similarity(a, b []byte) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(HammingDistance(a, b))/float64(n*8)
+}
+
+// wordDistance returns the Hamming distance between two unpacked hashes.
+func wordDistance(a, b []uint32) int {
+	d := 0
+	for i := range a {
+		d += bits.OnesCount32(a[i] ^ b[i])
+	}
+	return d
+}
+
+// DistanceMetric selects how hash distances are computed when matching.
+type DistanceMetric int
+
+const (
+	// DistanceHamming counts differing bits in Go. This is the default.
+	DistanceHamming DistanceMetric = iota
+	// DistanceNative uses OpenCV's BlockMeanHash.Compare, the algorithm's
+	// canonical distance. For block mean hashes that is also a Hamming
+	// distance, so results match DistanceHamming, but every comparison
+	// crosses into OpenCV, which is much slower for fuzzy scans.
+	DistanceNative
+)
+
+var distanceMetricNames = map[DistanceMetric]string{
+	DistanceHamming: "hamming",
+	DistanceNative:  "native",
+}
+
+func (m DistanceMetric) String() string {
+	if s, ok := distanceMetricNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("DistanceMetric(%d)", int(m))
+}
+
+// ParseDistanceMetric converts a metric name ("hamming", "native") to a
+// DistanceMetric.
+func ParseDistanceMetric(s string) (DistanceMetric, error) {
+	for m, name := range distanceMetricNames {
+		if s == name {
+			return m, nil
+		}
+	}
+	return DistanceHamming, fmt.Errorf("unknown distance metric %q", s)
+}
+
+// NativeDistance returns the distance between two hashes computed by
+// OpenCV's BlockMeanHash.Compare.
+func NativeDistance(a, b []byte) (int, error) {
+	ma, err := gocv.NewMatFromBytes(1, len(a), gocv.MatTypeCV8U, a)
+	if err != nil {
+		return 0, err
+	}
+	defer ma.Close()
+	mb, err := gocv.NewMatFromBytes(1, len(b), gocv.MatTypeCV8U, b)
+	if err != nil {
+		return 0, err
+	}
+	defer mb.Close()
+	return int(cv_contrib.BlockMeanHash{}.Compare(ma, mb)), nil
+}
+
+// packHash converts an unpacked hash back to bytes.
+func packHash(words []uint32) []byte {
+	result := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint32(result[4*i:], w)
+	}
+	return result
+}
+
+// metricDistance returns the distance between 'hash' and its unpacked form
+// 'un', and the unpacked stored hash 'stored', using 'metric'.
+func metricDistance(metric DistanceMetric, hash []byte, un, stored []uint32) (int, error) {
+	if metric == DistanceNative {
+		return NativeDistance(hash, packHash(stored))
+	}
+	return wordDistance(un, stored), nil
+}
@@ -0,0 +1,53 @@
+package phash
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+const estimateRowsQuery = "select count(*), coalesce(sum(length(fullpath)), 0) from %s"
+
+// hashBytes is the size of a block mean hash.
+const hashBytes = 32
+
+// bkChildOverhead approximates the memory used by each entry of a bkNode's
+// children map.
+const bkChildOverhead = 48
+
+// EstimateIndex returns the number of hashes an in-memory index (e.g. a
+// MemStore) of the DB would hold, including variants if any are configured,
+// and a rough estimate of the memory it would use in bytes. It only runs
+// aggregate queries, so it's cheap compared to loading the index.
+func (h *PHasher) EstimateIndex() (rows int, bytes int64, err error) {
+	db, err := h.openDB()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	tables := []string{h.tableQuery(defaultTable)}
+	if h.hasVariants() {
+		var n int
+		if err := db.QueryRow(tableExistsQuery, h.tableQuery("key_hash_variants")).Scan(&n); err != nil {
+			return 0, 0, err
+		}
+		if n > 0 {
+			tables = append(tables, h.tableQuery("key_hash_variants"))
+		}
+	}
+	// BuildIndex loads the stored words of each hash, not the full hash.
+	perRow := int64(unsafe.Sizeof(bkNode{})) + bkChildOverhead + int64(st.hashWords())*4
+	for _, table := range tables {
+		var n int
+		var keyBytes int64
+		if err := db.QueryRow(fmt.Sprintf(estimateRowsQuery, table)).Scan(&n, &keyBytes); err != nil {
+			return 0, 0, err
+		}
+		rows += n
+		bytes += int64(n)*perRow + keyBytes
+	}
+	return rows, bytes, nil
+}
@@ -0,0 +1,63 @@
+package phash
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const exportHashesQuery = "select fullpath, frame, h1, h2, h3, h4 from key_hashes order by fullpath, frame"
+
+// ExportHashes writes every stored frame to 'w' as "key,frame,hashhex"
+// lines, which ImportHashes reads back, and returns the number of frames
+// written. If 'gzipped' is set the output is gzip-compressed.
+func (h *PHasher) ExportHashes(w io.Writer, gzipped bool) (int, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.Query(st.tableQuery(exportHashesQuery))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var zw *gzip.Writer
+	if gzipped {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+	count := 0
+	stored := make([]uint32, st.hashWords())
+	for rows.Next() {
+		var key string
+		var frame int
+		if err := rows.Scan(append([]interface{}{&key, &frame}, wordDest(stored)...)...); err != nil {
+			return count, err
+		}
+		if _, err := fmt.Fprintf(bw, "%s,%d,%s\n", key, frame, hex.EncodeToString(packHash(stored))); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
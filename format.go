@@ -0,0 +1,146 @@
+package phash
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// HashFormat selects how hashes are rendered in show and query output.
+type HashFormat int
+
+const (
+	// HashDecimal prints the hash as an array of decimal uint32 words.
+	HashDecimal HashFormat = iota
+	// HashHex prints the raw hash bytes as lowercase hex.
+	HashHex
+	// HashBase64 prints the raw hash bytes as standard base64.
+	HashBase64
+)
+
+var hashFormatNames = map[HashFormat]string{
+	HashDecimal: "decimal",
+	HashHex:     "hex",
+	HashBase64:  "base64",
+}
+
+func (f HashFormat) String() string {
+	if s, ok := hashFormatNames[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("HashFormat(%d)", int(f))
+}
+
+// ParseHashFormat converts a format name ("decimal", "hex", "base64") to a
+// HashFormat.
+func ParseHashFormat(s string) (HashFormat, error) {
+	for f, name := range hashFormatNames {
+		if s == name {
+			return f, nil
+		}
+	}
+	return HashDecimal, fmt.Errorf("unknown hash format %q", s)
+}
+
+// Format renders a raw hash as a string.
+func (f HashFormat) Format(h []byte) string {
+	switch f {
+	case HashHex:
+		return hex.EncodeToString(h)
+	case HashBase64:
+		return base64.StdEncoding.EncodeToString(h)
+	default:
+		return fmt.Sprintf("%v", unpackHash(h))
+	}
+}
+
+// OutputFormat selects the layout of query output.
+type OutputFormat int
+
+const (
+	// OutputText prints one "path:hash:[keys]:[frames]" line per query
+	// image.
+	OutputText OutputFormat = iota
+	// OutputTSV prints one "distance<TAB>query<TAB>match<TAB>frame" line per
+	// match, as expected by scripts built around other perceptual hash
+	// tools. Query images without matches print nothing, and failed lookups
+	// are only logged.
+	OutputTSV
+)
+
+var outputFormatNames = map[OutputFormat]string{
+	OutputText: "text",
+	OutputTSV:  "tsv",
+}
+
+func (f OutputFormat) String() string {
+	if s, ok := outputFormatNames[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("OutputFormat(%d)", int(f))
+}
+
+// ParseOutputFormat converts a format name ("text", "tsv") to an
+// OutputFormat.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	for f, name := range outputFormatNames {
+		if s == name {
+			return f, nil
+		}
+	}
+	return OutputText, fmt.Errorf("unknown output format %q", s)
+}
+
+// TSV formats 'm' as an OutputTSV line, without a newline. The match is
+// identified by Path if it's known, and Key otherwise.
+func (m Match) TSV() string {
+	match := m.Path
+	if match == "" {
+		match = m.Key
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%d", m.Distance, m.Query, match, m.Frame)
+}
+
+// showLine formats a single line of show mode output.
+func (h *PHasher) showLine(path string, hash []byte) string {
+	return fmt.Sprintf("%v\t%v", path, h.HashFormat.Format(hash))
+}
+
+// queryLine formats a single line of query mode output.
+func (h *PHasher) queryLine(path string, hash []byte, paths []string, frames []int) string {
+	return fmt.Sprintf("%v:%v:%v:%v", path, h.HashFormat.Format(hash), paths, frames)
+}
+
+// queryErrorLine formats a query mode output line for a failed lookup.
+func (h *PHasher) queryErrorLine(path string, hash []byte, err error) string {
+	return fmt.Sprintf("%v:%v:error:%v", path, h.HashFormat.Format(hash), err)
+}
+
+// printQueryResult prints a single query mode result.
+func (h *PHasher) printQueryResult(r QueryResult) {
+	if h.OnlyNew && r.Err == nil {
+		if h.OutputFormat == OutputTSV {
+			fmt.Printf("%s\t%s\n", r.Class(), r.Path)
+		} else {
+			fmt.Printf("%v:%v\n", r.Path, r.Class())
+		}
+		return
+	}
+	if h.OutputFormat == OutputTSV {
+		for _, m := range r.Matches {
+			fmt.Println(m.TSV())
+		}
+		return
+	}
+	if r.Err != nil {
+		fmt.Println(h.queryErrorLine(r.Path, r.Hash, r.Err))
+		return
+	}
+	paths := make([]string, 0, len(r.Matches))
+	frames := make([]int, 0, len(r.Matches))
+	for _, m := range r.Matches {
+		paths = append(paths, m.Key)
+		frames = append(frames, m.Frame)
+	}
+	fmt.Println(h.queryLine(r.Path, r.Hash, paths, frames))
+}
@@ -0,0 +1,84 @@
+package phash
+
+import (
+	"fmt"
+
+	"gocv.io/x/gocv"
+)
+
+// GrayscaleMode selects how color images are reduced to grayscale before
+// hashing.
+type GrayscaleMode int
+
+const (
+	// GrayLuma uses OpenCV's luma weights. This is the default.
+	GrayLuma GrayscaleMode = iota
+	// GrayAverage weights the blue, green, and red channels equally.
+	GrayAverage
+	// GrayBlue, GrayGreen, and GrayRed hash a single channel.
+	GrayBlue
+	GrayGreen
+	GrayRed
+)
+
+var grayscaleModeNames = map[GrayscaleMode]string{
+	GrayLuma:    "luma",
+	GrayAverage: "average",
+	GrayBlue:    "blue",
+	GrayGreen:   "green",
+	GrayRed:     "red",
+}
+
+func (m GrayscaleMode) String() string {
+	if s, ok := grayscaleModeNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("GrayscaleMode(%d)", int(m))
+}
+
+// ParseGrayscaleMode converts a mode name ("luma", "average", "blue",
+// "green", "red") to a GrayscaleMode.
+func ParseGrayscaleMode(s string) (GrayscaleMode, error) {
+	for m, name := range grayscaleModeNames {
+		if s == name {
+			return m, nil
+		}
+	}
+	return GrayLuma, fmt.Errorf("unknown grayscale mode %q", s)
+}
+
+// toGray reduces an 8-bit BGR image to grayscale according to Grayscale.
+// The caller must close both images.
+func (h *PHasher) toGray(bgr gocv.Mat) gocv.Mat {
+	switch h.Grayscale {
+	case GrayBlue, GrayGreen, GrayRed:
+		channels := gocv.Split(bgr)
+		want := int(h.Grayscale - GrayBlue)
+		result := gocv.NewMat()
+		for i, c := range channels {
+			if i == want {
+				result.Close()
+				result = c
+			} else {
+				c.Close()
+			}
+		}
+		return result
+	case GrayAverage:
+		src := bgr.ToBytes()
+		n := bgr.Rows() * bgr.Cols()
+		dst := make([]byte, n)
+		for i := 0; i < n; i++ {
+			dst[i] = byte((uint32(src[i*3]) + uint32(src[i*3+1]) + uint32(src[i*3+2]) + 1) / 3)
+		}
+		gray, err := gocv.NewMatFromBytes(bgr.Rows(), bgr.Cols(), gocv.MatTypeCV8UC1, dst)
+		if err != nil {
+			return gocv.NewMat()
+		}
+		return gray
+	default:
+		gray := gocv.NewMat()
+		gocv.CvtColor(bgr, &gray, gocv.ColorBGRToGray)
+		return gray
+	}
+}
@@ -0,0 +1,34 @@
+package phash
+
+import "fmt"
+
+const countRowsQuery = "select count(*) from key_hashes"
+
+// RowCount returns the number of frames stored in the DB.
+func (h *PHasher) RowCount() (int, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var n int
+	err = db.QueryRow(h.tableQuery(countRowsQuery)).Scan(&n)
+	return n, err
+}
+
+// checkStoreAllowed returns an error if a store would re-insert into a
+// non-empty DB without Since, Checkpoint, or Force set. Custom Stores and
+// sharded DBs are not checked.
+func (h *PHasher) checkStoreAllowed() error {
+	if h.Force || !h.Since.IsZero() || h.Checkpoint != "" || h.Store != nil || h.DBTemplate != "" {
+		return nil
+	}
+	n, err := h.RowCount()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("DB %q already has %d rows; set Force to store anyway, Since for an incremental store, or Checkpoint to resume", h.DBFile, n)
+	}
+	return nil
+}
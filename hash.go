@@ -0,0 +1,194 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+	stdimage "image"
+	"sync"
+
+	"gocv.io/x/gocv"
+	cv_contrib "gocv.io/x/gocv/contrib"
+)
+
+// ErrEmptyImage is returned when an image can't be decoded.
+var ErrEmptyImage = errors.New("empty image")
+
+// ErrCropOutside is returned when CropRect doesn't overlap an image.
+var ErrCropOutside = errors.New("crop rectangle outside image")
+
+// ErrTooSmall is returned when an image is smaller than MinDimension.
+var ErrTooSmall = errors.New("image too small")
+
+// ErrNoHashSupport is returned by CheckHashSupport when OpenCV can't compute
+// hashes.
+var ErrNoHashSupport = errors.New("OpenCV contrib img_hash module not found")
+
+var (
+	hashSupportOnce sync.Once
+	hashSupportErr  error
+)
+
+// CheckHashSupport verifies that OpenCV was built with the contrib img_hash
+// module by hashing a small blank image, returning ErrNoHashSupport if it
+// can't. It also detects the length of computed hashes, returning an error
+// if it's too short to store. The result is cached.
+func CheckHashSupport() error {
+	hashSupportOnce.Do(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				hashSupportErr = fmt.Errorf("%v: %v", ErrNoHashSupport, r)
+			}
+		}()
+		img := gocv.NewMatWithSize(8, 8, gocv.MatTypeCV8U)
+		defer img.Close()
+		hash := gocv.NewMat()
+		defer hash.Close()
+		cv_contrib.BlockMeanHash{}.Compute(img, &hash)
+		if hash.Empty() {
+			hashSupportErr = ErrNoHashSupport
+			return
+		}
+		n := len(hash.ToBytes())
+		if hashWords(n) == 0 {
+			hashSupportErr = fmt.Errorf("OpenCV computes %d-byte hashes; at least 4 bytes are needed", n)
+			return
+		}
+		hashLen = n
+	})
+	return hashSupportErr
+}
+
+// prepareImage returns the part of a decoded image to hash: the whole image,
+// or its intersection with CropRect, passed through Preprocess if it's set.
+// It returns ErrTooSmall if the result is smaller than MinDimension. The
+// caller must close the result.
+func (h *PHasher) prepareImage(img gocv.Mat) (gocv.Mat, error) {
+	r := stdimage.Rect(0, 0, img.Cols(), img.Rows())
+	if !h.CropRect.Empty() {
+		r = r.Intersect(h.cropRect())
+		if r.Empty() {
+			return gocv.NewMat(), ErrCropOutside
+		}
+	}
+	out := img.Region(r)
+	if h.Preprocess != nil {
+		region := out
+		var err error
+		out, err = h.Preprocess(region)
+		if err != nil {
+			region.Close()
+			return gocv.NewMat(), fmt.Errorf("preprocess: %v", err)
+		}
+		if out.Ptr() != region.Ptr() {
+			region.Close()
+		}
+	}
+	if min := h.minDimension(); out.Cols() < min || out.Rows() < min {
+		return out, ErrTooSmall
+	}
+	return out, nil
+}
+
+// defaultMinDimension is the minimum image width and height if MinDimension
+// is unset.
+const defaultMinDimension = 8
+
+func (h *PHasher) minDimension() int {
+	if h.MinDimension == 0 {
+		return defaultMinDimension
+	}
+	return h.MinDimension
+}
+
+// hashImage prepares and hashes a decoded image.
+func (h *PHasher) hashImage(img gocv.Mat) ([]byte, error) {
+	prepared, err := h.prepareImage(img)
+	defer prepared.Close()
+	if err != nil {
+		return nil, err
+	}
+	return h.hashMat(prepared), nil
+}
+
+// computeHash returns the perceptual hash of a grayscale image. The caller
+// must close the result.
+func (h *PHasher) computeHash(img gocv.Mat) gocv.Mat {
+	hash := gocv.NewMat()
+	cv_contrib.BlockMeanHash{}.Compute(img, &hash)
+	return hash
+}
+
+// hashMat returns the hash of 'img' as bytes.
+func (h *PHasher) hashMat(img gocv.Mat) []byte {
+	hash := h.computeHash(img)
+	defer hash.Close()
+	return hash.ToBytes()
+}
+
+// HashFile returns the hash of a single image file.
+func (h *PHasher) HashFile(p string) ([]byte, error) {
+	img := h.readImage(p)
+	defer img.Close()
+	if img.Empty() {
+		return nil, fmt.Errorf("%q: %v", p, ErrEmptyImage)
+	}
+	return h.hashImage(img)
+}
+
+// HashBytes decodes an encoded image (e.g. JPEG or PNG bytes) and returns its
+// hash, using the same decoding settings as images read from disk.
+func (h *PHasher) HashBytes(data []byte) ([]byte, error) {
+	img := h.decodeImage(data)
+	defer img.Close()
+	if img.Empty() {
+		return nil, ErrEmptyImage
+	}
+	return h.hashImage(img)
+}
+
+// HashMat hashes a decoded grayscale image like HashBytes, but returns the
+// hash as the Mat computed by OpenCV, e.g. for BlockMeanHash.Compare. The
+// caller must close the result.
+func (h *PHasher) HashMat(img gocv.Mat) (gocv.Mat, error) {
+	prepared, err := h.prepareImage(img)
+	defer prepared.Close()
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	return h.computeHash(prepared), nil
+}
+
+// HashFileMat is like HashFile, but returns the hash as a Mat that the caller
+// must close.
+func (h *PHasher) HashFileMat(p string) (gocv.Mat, error) {
+	img := h.readImage(p)
+	defer img.Close()
+	if img.Empty() {
+		return gocv.NewMat(), fmt.Errorf("%q: %v", p, ErrEmptyImage)
+	}
+	return h.HashMat(img)
+}
+
+// FileHash describes the hash of a single image file, for debugging.
+type FileHash struct {
+	// Width and Height are the decoded image's dimensions, before CropRect.
+	Width, Height int
+	Hash          []byte
+	// Words are the 32-bit words of Hash stored in the 'key_hashes' table.
+	Words []uint32
+}
+
+// InspectFile hashes a single image file like HashFile, without touching the
+// DB, and also returns its dimensions and stored words.
+func (h *PHasher) InspectFile(p string) (FileHash, error) {
+	img := h.readImage(p)
+	defer img.Close()
+	if img.Empty() {
+		return FileHash{}, fmt.Errorf("%q: %v", p, ErrEmptyImage)
+	}
+	hash, err := h.hashImage(img)
+	if err != nil {
+		return FileHash{}, err
+	}
+	return FileHash{Width: img.Cols(), Height: img.Rows(), Hash: hash, Words: unpackHash(hash)}, nil
+}
@@ -0,0 +1,128 @@
+package phash
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// hashWords returns the number of 32-bit words stored for hashes of 'n'
+// bytes: one per 4 bytes, up to storedHashWords. Longer hashes are
+// truncated (see unpackHash).
+func hashWords(n int) int {
+	if n/4 < storedHashWords {
+		return n / 4
+	}
+	return storedHashWords
+}
+
+// hashColumnLists are the lists of hash word columns in queries written for
+// storedHashWords columns, as a format for each column and the separator
+// between them. Longer formats come first so that bare lists don't match
+// parts of them.
+var hashColumnLists = []struct{ format, sep string }{
+	{"ifnull(h%d, 0)", ", "},
+	{"h%d bigint", ", "},
+	{"h%d = ?", " and "},
+	{"h%d = ?", ", "},
+	{"h%d = 0", " and "},
+	{"h%d is null", " or "},
+	{"h%d", ", "},
+}
+
+// valuesRe matches the placeholders of an INSERT statement.
+var valuesRe = regexp.MustCompile(`values\(\?(,\?)*\)`)
+
+// columnList returns the list of 'words' hash columns in form 'format'.
+func columnList(format, sep string, words int) string {
+	cols := make([]string, words)
+	for i := range cols {
+		cols[i] = fmt.Sprintf(format, i+1)
+	}
+	return strings.Join(cols, sep)
+}
+
+// hashQuery rewrites query 'q', written for tables with storedHashWords hash
+// columns, h1 to h4, for tables with 'words' columns.
+func hashQuery(q string, words int) string {
+	if words == storedHashWords {
+		return q
+	}
+	for _, l := range hashColumnLists {
+		q = strings.Replace(q, columnList(l.format, l.sep, storedHashWords), columnList(l.format, l.sep, words), -1)
+	}
+	return valuesRe.ReplaceAllStringFunc(q, func(values string) string {
+		n := strings.Count(values, "?") - storedHashWords + words
+		return "values(" + strings.TrimSuffix(strings.Repeat("?,", n), ",") + ")"
+	})
+}
+
+// tableHashWords returns the number of hash word columns of hash table
+// 'table' in 'db', or if it doesn't exist yet, the number Init creates for
+// the hashes OpenCV computes.
+func tableHashWords(db *sql.DB, table string) (int, error) {
+	columns, err := hashColumns(db, table)
+	if err != nil {
+		return 0, err
+	}
+	if columns == 0 {
+		return hashWords(runtimeHashLen()), nil
+	}
+	if columns > storedHashWords {
+		return 0, fmt.Errorf("table %q has %d hash columns; at most %d are supported", table, columns, storedHashWords)
+	}
+	return columns, nil
+}
+
+// loadHashWords detects the number of hash word columns of Table, once,
+// when the store is opened. Queries are then rewritten for it by
+// tableQuery.
+func (s *SQLiteStore) loadHashWords() error {
+	s.wordsOnce.Do(func() {
+		s.words, s.wordsErr = tableHashWords(s.db, s.Table)
+	})
+	return s.wordsErr
+}
+
+// hashWords returns the number of hash word columns of Table. If it
+// couldn't be detected, it's the number for the hashes OpenCV computes, and
+// queries fail on their own.
+func (s *SQLiteStore) hashWords() int {
+	if s.loadHashWords() != nil {
+		return hashWords(runtimeHashLen())
+	}
+	return s.words
+}
+
+// unpack returns the words of 'hash' stored in the store's hash columns.
+func (s *SQLiteStore) unpack(hash []byte) []uint32 {
+	return unpackWords(hash, s.hashWords())
+}
+
+// wordArgs returns 'words' as query arguments, followed by 'more'.
+func wordArgs(words []uint32, more ...interface{}) []interface{} {
+	args := make([]interface{}, 0, len(words)+len(more))
+	for _, w := range words {
+		args = append(args, w)
+	}
+	return append(args, more...)
+}
+
+// wordDest returns scan destinations for the hash word columns of a row
+// into 'words'.
+func wordDest(words []uint32) []interface{} {
+	dest := make([]interface{}, len(words))
+	for i := range words {
+		dest[i] = &words[i]
+	}
+	return dest
+}
+
+// hashStore returns a SQLiteStore on 'db' for Table, with its hash columns
+// detected, for building queries and unpacking hashes for them.
+func (h *PHasher) hashStore(db *sql.DB) (*SQLiteStore, error) {
+	st := NewSQLiteStore(db)
+	st.Table = h.Table
+	return st, st.loadHashWords()
+}
@@ -0,0 +1,74 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestHashQuery(t *testing.T) {
+	for _, tt := range []struct {
+		q, want string
+	}{
+		{insertHashesQuery, "INSERT INTO key_hashes(fullpath, frame, h1, h2) values(?,?,?,?)"},
+		{insertVariantQuery, "INSERT INTO key_hash_variants(fullpath, frame, variant, h1, h2) values(?,?,?,?,?)"},
+		{lookupHashesQuery, "select fullpath, frame from key_hashes where h1 = ? and h2 = ?"},
+		{updateHashQuery, "UPDATE key_hashes SET h1 = ?, h2 = ? where fullpath = ? and frame = ?"},
+		{createTableQuery, "CREATE TABLE IF NOT EXISTS key_hashes(fullpath text, mtime text, frame integer, h1 bigint, h2 bigint, UNIQUE(fullpath, frame))"},
+		{nullColumnsQuery, "select count(*) from key_hashes where fullpath is null or frame is null or h1 is null or h2 is null"},
+		{indexSourceQuery, "select ifnull(fullpath, ''), ifnull(frame, 0), '', ifnull(h1, 0), ifnull(h2, 0) from key_hashes"},
+	} {
+		if got := hashQuery(tt.q, 2); got != tt.want {
+			t.Errorf("hashQuery(%q, 2) = %q, want %q", tt.q, got, tt.want)
+		}
+		if got := hashQuery(tt.q, storedHashWords); got != tt.q {
+			t.Errorf("hashQuery(%q, %d) = %q", tt.q, storedHashWords, got)
+		}
+	}
+}
+
+func TestSQLiteStoreTwoHashColumns(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	dbFile := filepath.Join(t.TempDir(), "phash.db")
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, q := range []string{createTableQuery, createVariantsQuery} {
+		if _, err := db.Exec(hashQuery(q, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewSQLiteStore(db)
+	defer s.closeStmts()
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if width, err := s.HashWidth(); err != nil || width != 8 {
+		t.Fatalf("got hash width %d, %v, want 8", width, err)
+	}
+	hash := testHash(1)
+	if _, err := s.Insert([]Result{{Key: "a", Frame: 1, Hash: hash}}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first two words are stored, so later bits don't matter.
+	for _, maxDist := range []int{0, 2} {
+		matches, err := s.Lookup(context.Background(), flipBit(hash, 100), maxDist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 || matches[0].Distance != 0 {
+			t.Errorf("maxdist %d: got matches %+v, want frame a 1", maxDist, matches)
+		}
+	}
+	n, err := s.Count(context.Background(), hash, 0, 0)
+	if err != nil || n != 1 {
+		t.Errorf("got count %d, %v, want 1", n, err)
+	}
+}
@@ -0,0 +1,59 @@
+package phash
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// hashLen is the length in bytes of the hashes computed by the runtime's
+// OpenCV, detected by CheckHashSupport. Some builds compute a different
+// length than hashBytes; only the first storedHashWords words are stored.
+var hashLen = hashBytes
+
+// runtimeHashLen returns hashLen once CheckHashSupport has detected it, or
+// hashBytes if hashing isn't supported.
+func runtimeHashLen() int {
+	if CheckHashSupport() != nil {
+		return hashBytes
+	}
+	return hashLen
+}
+
+// warnHashLen warns if OpenCV computes hashes of a length other than
+// hashBytes.
+func (h *PHasher) warnHashLen() {
+	if n := runtimeHashLen(); n != hashBytes {
+		h.infof("OpenCV computes %d-byte hashes rather than %d; DBs must be built with the same length", n, hashBytes)
+	}
+}
+
+// checkHashLen returns an error if 'hash' isn't as long as the hashes this
+// OpenCV computes.
+func checkHashLen(hash []byte) error {
+	if n := runtimeHashLen(); len(hash) != n {
+		return fmt.Errorf("expected %d-byte hash, got %d bytes", n, len(hash))
+	}
+	return nil
+}
+
+// hashLenSetting returns the "hashlen" setting for hashes of 'n' bytes,
+// empty for the default hashBytes.
+func hashLenSetting(n int) string {
+	if n == hashBytes {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// settingHashLen returns the hash length recorded in 'settings'.
+func settingHashLen(settings map[string]string) (int, error) {
+	v := settings["hashlen"]
+	if v == "" {
+		return hashBytes, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid hashlen setting %q", v)
+	}
+	return n, nil
+}
@@ -0,0 +1,98 @@
+package phash
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// hashAlgorithm names the hash computed by this package in the DB's
+// settings. It's recorded as empty, like other defaults, so DBs built before
+// it was recorded still match; DBs built with another algorithm record a
+// different name and are refused by checkSettings.
+const hashAlgorithm = ""
+
+// hashWidthStore is implemented by Stores that can report the width of
+// their stored hashes.
+type hashWidthStore interface {
+	HashWidth() (int, error)
+}
+
+// storedHashWords is the most 32-bit words of each hash stored in
+// 'key_hashes'; longer hashes are truncated (see unpackHash).
+const storedHashWords = 4
+
+// hashColumnRe matches the columns of 'key_hashes' holding hash words.
+var hashColumnRe = regexp.MustCompile("^h[0-9]+$")
+
+const sampleHashQuery = "select h1, h2, h3, h4 from key_hashes limit 1"
+
+// HashWidth returns the width in bytes of the hashes stored in 'key_hashes',
+// inferred from its hash columns, each of which holds 32 bits, and checked
+// against a stored row. It returns 0 if the table doesn't exist.
+func (s *SQLiteStore) HashWidth() (int, error) {
+	columns, err := hashColumns(s.db, s.Table)
+	if err != nil || columns == 0 || columns > storedHashWords {
+		return columns * 4, err
+	}
+	words := make([]int64, columns)
+	dest := make([]interface{}, columns)
+	for i := range words {
+		dest[i] = &words[i]
+	}
+	err = s.db.QueryRow(tableQuery(hashQuery(sampleHashQuery, columns), s.Table)).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return columns * 4, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, w := range words {
+		if w < 0 || w > math.MaxUint32 {
+			return 0, fmt.Errorf("stored hash word %d doesn't fit in 32 bits; the DB was built with a different hash", w)
+		}
+	}
+	return columns * 4, nil
+}
+
+// hashColumns returns the number of hash word columns in hash table 'table'
+// of 'db', or 0 if it doesn't exist.
+func hashColumns(db *sql.DB, table string) (int, error) {
+	rows, err := db.Query(tableQuery("PRAGMA table_info(key_hashes)", table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns := 0
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return 0, err
+		}
+		if hashColumnRe.MatchString(name) {
+			columns++
+		}
+	}
+	return columns, rows.Err()
+}
+
+// checkHashWidth returns an error if 'st' holds hashes of a different width
+// than it would store for the hashes OpenCV computes. Stores that can't report their width, and
+// uninitialized DBs, are not checked.
+func checkHashWidth(st Store) error {
+	hs, ok := st.(hashWidthStore)
+	if !ok {
+		return nil
+	}
+	width, err := hs.HashWidth()
+	if err != nil {
+		return err
+	}
+	if want := hashWords(runtimeHashLen()) * 4; width != 0 && width != want {
+		return fmt.Errorf("DB stores %d-bit hashes, expected %d bits; it was built with a different hash", width*8, want*8)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package phash
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImportHashes reads "path,hashhex" lines from 'r' and stores them in the DB,
+// returning the number of rows imported; frames already stored are skipped
+// and not counted. Keys and frames are derived from each path the same way
+// as for image directories; paths that don't look like frame images are
+// stored with the full path as key and frame 0. Lines of the form
+// "key,frame,hashhex", as written by ExportHashes, are stored as is.
+// Gzip-compressed input is detected and decompressed.
+//
+// Hashes must be as long as those OpenCV computes. Only their first words,
+// up to 4 × 32 bits, are stored in the key_hashes columns; any further bits
+// are accepted but discarded. This is intended for seeding the DB from Python's imagehash (e.g.
+// average_hash(img, hash_size=16)). Note that imagehash and OpenCV's block mean
+// hash are different algorithms: exact matches between imported hashes and
+// hashes computed by this package are unlikely, and fuzzy matches are only
+// approximate.
+func (h *PHasher) ImportHashes(r io.Reader) (int, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(st.tableQuery(insertHashesQuery))
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		i := strings.LastIndex(text, ",")
+		if i < 0 {
+			return count, fmt.Errorf("line %d: expected path,hashhex", line)
+		}
+		p, hashHex := text[:i], strings.TrimSpace(text[i+1:])
+		hash, err := hex.DecodeString(hashHex)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := checkHashLen(hash); err != nil {
+			return count, fmt.Errorf("line %d: %v", line, err)
+		}
+		key, frame := h.importKey(p)
+		if j := strings.LastIndex(p, ","); j >= 0 {
+			if n, err := strconv.Atoi(p[j+1:]); err == nil {
+				key, frame = h.normalizeKey(filepath.ToSlash(p[:j])), n
+			}
+		}
+		_, err = stmt.Exec(append([]interface{}{key, frame}, wordArgs(st.unpack(hash))...)...)
+		if err != nil && !isUniqueErr(err) {
+			return count, fmt.Errorf("line %d: %v", line, err)
+		}
+		if err == nil {
+			count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	h.infof("imported %d hashes", count)
+	return count, nil
+}
+
+// importKey derives a key and frame number from an imported image path.
+func (h *PHasher) importKey(p string) (string, int) {
+	p = filepath.ToSlash(p)
+	dir, name := path.Split(p)
+	matches := frameRe.FindStringSubmatch(name)
+	if matches == nil {
+		return h.normalizeKey(p), 0
+	}
+	frame, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return h.normalizeKey(p), 0
+	}
+	return h.normalizeKey(path.Join(dir, matches[1])), frame
+}
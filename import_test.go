@@ -0,0 +1,53 @@
+package phash
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testDB returns a PHasher on a new DB in a temporary directory holding
+// 'results'.
+func testDB(t *testing.T, results ...Result) *PHasher {
+	t.Helper()
+	h := &PHasher{DBFile: filepath.Join(t.TempDir(), "phash.db"), Quiet: true}
+	if err := h.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := st.Insert(results); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestImportHashesSkipsStoredFrames(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := testDB(t, Result{Key: "video", Frame: 1, Hash: testHash(1)})
+	var lines []string
+	for i := 1; i <= 3; i++ {
+		lines = append(lines, fmt.Sprintf("video-%04d.jpg,%s", i, hex.EncodeToString(testHash(i))))
+	}
+	// Frame 1 is already stored, and frame 3 is listed twice.
+	lines = append(lines, lines[2])
+	n, err := h.ImportHashes(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("imported %d hashes, want 2", n)
+	}
+	if rows := hashRows(t, h.DBFile); len(rows) != 3 {
+		t.Errorf("got %d rows, want 3", len(rows))
+	}
+}
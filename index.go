@@ -0,0 +1,215 @@
+package phash
+
+import (
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+)
+
+// indexVersion is the version of the file format written by MemStore.Save.
+const indexVersion = 1
+
+// indexSource identifies the DB contents an index was built from.
+type indexSource struct {
+	Rows     int
+	Checksum int64
+}
+
+// indexSourceQuery and indexVariantsSourceQuery select what indexSource
+// summarizes from the hash and variants tables.
+const indexSourceQuery = "select ifnull(fullpath, ''), ifnull(frame, 0), '', ifnull(h1, 0), ifnull(h2, 0), ifnull(h3, 0), ifnull(h4, 0) from key_hashes"
+const indexVariantsSourceQuery = "select ifnull(fullpath, ''), ifnull(frame, 0), ifnull(variant, ''), ifnull(h1, 0), ifnull(h2, 0), ifnull(h3, 0), ifnull(h4, 0) from key_hash_variants"
+
+// indexSource returns the indexSource of the DB's hash table: its number of
+// rows, and an order-independent checksum of every row of it and of its
+// variants table, which changes whenever frames or variants are added,
+// removed, rekeyed, or rehashed.
+func (h *PHasher) indexSource() (indexSource, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return indexSource{}, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return indexSource{}, err
+	}
+	queries := []string{indexSourceQuery}
+	var n int
+	if err := db.QueryRow(tableExistsQuery, h.tableQuery("key_hash_variants")).Scan(&n); err != nil {
+		return indexSource{}, err
+	}
+	if n > 0 {
+		queries = append(queries, indexVariantsSourceQuery)
+	}
+	var src indexSource
+	var sum uint64
+	for i, q := range queries {
+		rows, err := db.Query(st.tableQuery(q))
+		if err != nil {
+			return indexSource{}, err
+		}
+		words := make([]uint32, st.hashWords())
+		for rows.Next() {
+			var key, variant string
+			var frame int64
+			if err := rows.Scan(append([]interface{}{&key, &frame, &variant}, wordDest(words)...)...); err != nil {
+				rows.Close()
+				return indexSource{}, err
+			}
+			f := fnv.New64a()
+			fmt.Fprintf(f, "%q %d %q %v", key, frame, variant, words)
+			sum += f.Sum64()
+			if i == 0 {
+				src.Rows++
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return indexSource{}, err
+		}
+	}
+	src.Checksum = int64(sum)
+	return src, nil
+}
+
+// BuildIndex loads every stored hash, and variants if any are configured,
+// into a MemStore, for fast fuzzy lookups that don't touch the DB. Hashes
+// are stored truncated, as in the DB (see unpackHash), and so are query
+// hashes. The index can be saved with MemStore.Save and reloaded with
+// LoadIndex to avoid rebuilding it.
+func (h *PHasher) BuildIndex() (*MemStore, error) {
+	src, err := h.indexSource()
+	if err != nil {
+		return nil, err
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return nil, err
+	}
+	s := NewMemStore()
+	s.hashBytes = st.hashWords() * 4
+	s.source = src
+	queries := []string{scanAllHashesQuery}
+	if h.hasVariants() {
+		var n int
+		if err := db.QueryRow(tableExistsQuery, h.tableQuery("key_hash_variants")).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			queries = append(queries, scanAllVariantsQuery)
+		}
+	}
+	nulls := 0
+	stored := make([]uint32, st.hashWords())
+	for i, q := range queries {
+		rows, err := db.Query(st.tableQuery(q))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var row hashRow
+			if err := rows.Scan(row.dest(len(stored))...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !row.valid() {
+				nulls++
+				continue
+			}
+			m := row.match(stored)
+			s.add(bkEntry{hash: packHash(stored), key: m.Key, frame: m.Frame}, i > 0)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	logNullRows(nulls)
+	return s, nil
+}
+
+// indexFile is the gob-encoded contents of a saved MemStore.
+type indexFile struct {
+	Version   int
+	HashBytes int
+	Source    indexSource
+	Entries   []indexEntry
+}
+
+// indexEntry is a saved bkEntry.
+type indexEntry struct {
+	Hash     []byte
+	Key      string
+	Frame    int
+	Path     string
+	Metadata map[string]string
+	Variant  bool
+}
+
+// Save writes the index to 'file', replacing it atomically, so it can be
+// reloaded with LoadIndex.
+func (s *MemStore) Save(file string) error {
+	s.mu.RLock()
+	out := indexFile{Version: indexVersion, HashBytes: s.hashBytes, Source: s.source}
+	out.Entries = make([]indexEntry, 0, s.tree.size)
+	s.tree.walk(func(e bkEntry) {
+		out.Entries = append(out.Entries, indexEntry{e.hash, e.key, e.frame, e.path, e.metadata, e.variant})
+	})
+	s.mu.RUnlock()
+
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(&out); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// LoadIndex reads an index written by MemStore.Save. If DBFile is set and
+// the index was built from a DB (see BuildIndex), it warns if the DB's
+// frames have changed since, in which case the index should be rebuilt.
+func (h *PHasher) LoadIndex(file string) (*MemStore, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var in indexFile
+	if err := gob.NewDecoder(f).Decode(&in); err != nil {
+		return nil, fmt.Errorf("%q: %v", file, err)
+	}
+	if in.Version != indexVersion {
+		return nil, fmt.Errorf("%q: index version %d, expected %d", file, in.Version, indexVersion)
+	}
+	s := NewMemStore()
+	s.hashBytes = in.HashBytes
+	s.source = in.Source
+	for _, e := range in.Entries {
+		s.add(bkEntry{hash: e.Hash, key: e.Key, frame: e.Frame, path: e.Path, metadata: e.Metadata}, e.Variant)
+	}
+	if h.DBFile != "" && in.Source != (indexSource{}) {
+		src, err := h.indexSource()
+		if err != nil {
+			return nil, err
+		}
+		if src != in.Source {
+			h.infof("warning: index %q is stale: built from %d frames, DB now has %d or they've changed; rebuild it with BuildIndex", file, in.Source.Rows, src.Rows)
+		}
+	}
+	return s, nil
+}
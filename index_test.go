@@ -0,0 +1,44 @@
+package phash
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestIndexSourceChanges(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := testDB(t,
+		Result{Key: "a", Frame: 1, Hash: testHash(1), Variants: []Variant{{Name: "flip", Hash: testHash(2)}}},
+		Result{Key: "a", Frame: 2, Hash: testHash(3)},
+	)
+	last, err := h.indexSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"update key_hashes set fullpath = 'b'",
+		"update key_hash_variants set variant = 'rot90'",
+		"update key_hash_variants set h1 = h1 + 1",
+		"update key_hashes set frame = frame + 10",
+	} {
+		db, err := sql.Open("sqlite3", h.DBFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(q)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := h.indexSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src == last {
+			t.Errorf("%q: index source unchanged", q)
+		}
+		last = src
+	}
+}
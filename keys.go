@@ -0,0 +1,62 @@
+package phash
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const listKeysQuery = "select fullpath, count(*) from key_hashes where substr(fullpath, 1, length(?)) = ? group by fullpath order by fullpath"
+
+// normalizeKey returns 'key' lower-cased and NFC-normalized if FoldKeys is
+// set, and unchanged otherwise.
+func (h *PHasher) normalizeKey(key string) string {
+	if !h.FoldKeys {
+		return key
+	}
+	return norm.NFC.String(strings.ToLower(key))
+}
+
+// KeyCount is a key and the number of frames stored for it.
+type KeyCount struct {
+	Key    string
+	Frames int
+}
+
+// KeyCounts returns the distinct keys in the DB starting with 'prefix', in
+// order, along with their frame counts.
+func (h *PHasher) KeyCounts(prefix string) ([]KeyCount, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	prefix = h.normalizeKey(prefix)
+	rows, err := db.Query(h.tableQuery(listKeysQuery), prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []KeyCount
+	for rows.Next() {
+		var kc KeyCount
+		if err := rows.Scan(&kc.Key, &kc.Frames); err != nil {
+			return nil, err
+		}
+		result = append(result, kc)
+	}
+	return result, rows.Err()
+}
+
+// Keys returns the distinct keys in the DB starting with 'prefix', in order.
+func (h *PHasher) Keys(prefix string) ([]string, error) {
+	counts, err := h.KeyCounts(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(counts))
+	for i, kc := range counts {
+		keys[i] = kc.Key
+	}
+	return keys, nil
+}
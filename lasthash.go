@@ -0,0 +1,50 @@
+package phash
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// lastHashShards is the number of partitions of a lastHashes.
+const lastHashShards = 16
+
+// lastHashes holds the last stored hash of each key during a store run, so
+// gating such as SceneThreshold doesn't need a DB query per frame. It's
+// partitioned by key, so workers handling different keys rarely contend.
+type lastHashes struct {
+	shards [lastHashShards]lastHashShard
+}
+
+type lastHashShard struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func newLastHashes() *lastHashes {
+	l := &lastHashes{}
+	for i := range l.shards {
+		l.shards[i].m = make(map[string][]byte)
+	}
+	return l
+}
+
+func (l *lastHashes) shard(key string) *lastHashShard {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return &l.shards[f.Sum32()%lastHashShards]
+}
+
+// update calls 'keep' with the last hash stored for 'key', if any, and
+// records 'hash' as the last one if it returns true. It returns the result
+// of 'keep'. The check and update are atomic.
+func (l *lastHashes) update(key string, hash []byte, keep func(prev []byte, ok bool) bool) bool {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.m[key]
+	if !keep(prev, ok) {
+		return false
+	}
+	s.m[key] = hash
+	return true
+}
@@ -0,0 +1,43 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStoreLocked is returned when another process is storing into the same
+// DB.
+var ErrStoreLocked = errors.New("another store is running on this DB")
+
+// errLockHeld is returned by tryLock when the lock is held elsewhere.
+var errLockHeld = errors.New("lock held")
+
+// lockPollInterval is how often lockStore retries while waiting.
+const lockPollInterval = 100 * time.Millisecond
+
+// lockStore takes the advisory lock on DBFile's lock file, DBFile+".lock",
+// waiting as configured by LockWait. It returns a function to release the
+// lock. Custom Stores and sharded DBs aren't locked.
+func (h *PHasher) lockStore() (func(), error) {
+	if h.DBFile == "" || h.Store != nil || h.DBTemplate != "" {
+		return func() {}, nil
+	}
+	name := h.DBFile + ".lock"
+	deadline := time.Now().Add(h.LockWait)
+	logged := false
+	for {
+		unlock, err := tryLock(name)
+		if err != errLockHeld {
+			return unlock, err
+		}
+		if h.LockWait >= 0 && !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%v (lock file %q)", ErrStoreLocked, name)
+		}
+		if !logged {
+			h.infof("waiting for another store to finish (lock file %q)", name)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package phash
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on 'name', creating it if needed. The
+// lock is released if the process dies.
+func tryLock(name string) (func(), error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLockHeld
+		}
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
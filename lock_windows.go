@@ -0,0 +1,17 @@
+package phash
+
+import "os"
+
+// tryLock creates 'name' exclusively, and removes it on release. A lock file
+// left behind by a crashed process must be removed by hand.
+func tryLock(name string) (func(), error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, errLockHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() { os.Remove(name) }, nil
+}
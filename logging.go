@@ -0,0 +1,65 @@
+package phash
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel controls which messages PHasher logs. Errors are always logged.
+type LogLevel int
+
+const (
+	// LogError logs only errors.
+	LogError LogLevel = -1
+	// LogInfo additionally logs warnings and summaries. This is the default.
+	LogInfo LogLevel = 0
+	// LogDebug additionally logs per-file and per-commit progress.
+	LogDebug LogLevel = 1
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogError: "error",
+	LogInfo:  "info",
+	LogDebug: "debug",
+}
+
+func (l LogLevel) String() string {
+	if s, ok := logLevelNames[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel converts a level name ("error", "info", "debug") to a
+// LogLevel.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l, name := range logLevelNames {
+		if s == name {
+			return l, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// logLevel returns the effective log level: LogError if Quiet is set, and
+// LogLevel otherwise.
+func (h *PHasher) logLevel() LogLevel {
+	if h.Quiet {
+		return LogError
+	}
+	return h.LogLevel
+}
+
+// infof logs a message at LogInfo.
+func (h *PHasher) infof(format string, v ...interface{}) {
+	if h.logLevel() >= LogInfo {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// debugf logs a message at LogDebug.
+func (h *PHasher) debugf(format string, v ...interface{}) {
+	if h.logLevel() >= LogDebug {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
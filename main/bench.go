@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pyrovski/phash"
+)
+
+// benchStats accumulates commit metrics across benchmark iterations.
+type benchStats struct {
+	sync.Mutex
+	images    int
+	commits   int
+	retries   int
+	failures  int
+	latencies []time.Duration
+}
+
+func (s *benchStats) commit(images int, latency time.Duration, retries int, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.images += images
+	s.commits++
+	s.retries += retries
+	if err != nil {
+		s.failures++
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+// percentile returns the p'th percentile of sorted durations 'd'.
+func percentile(d []time.Duration, p int) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	i := len(d) * p / 100
+	if i >= len(d) {
+		i = len(d) - 1
+	}
+	return d[i]
+}
+
+// bench runs the store pipeline over sample directories several times and
+// reports throughput and commit latency.
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	iterations := fs.Int("iterations", 3, "number of store runs")
+	procs := fs.Int("procs", 1, "# of goroutines for processing hashes")
+	batch := fs.Int("batch", 100, "# of frames per DB commit")
+	dbFile := fs.String("db", "", "sqlite3 DB file; a fresh temporary DB is used per iteration if unset")
+	dbTimeout := fs.Duration("dbtimeout", 30*time.Second, "timeout for DB operations")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s bench [flags] dir...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	dirs := fs.Args()
+	if len(dirs) < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	stats := &benchStats{}
+	var elapsed time.Duration
+	for i := 0; i < *iterations; i++ {
+		hasher := phash.PHasher{
+			DBFile:    *dbFile,
+			DBTimeout: *dbTimeout,
+			HashProcs: *procs,
+			BatchSize: *batch,
+			Force:     true,
+			Metrics:   phash.Metrics{Commit: stats.commit},
+		}
+		var tmpDir string
+		if hasher.DBFile == "" {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "phash-bench")
+			if err != nil {
+				log.Fatal(err)
+			}
+			hasher.DBFile = path.Join(tmpDir, "bench.sqlite")
+		}
+		if err := hasher.InitDB(); err != nil {
+			log.Fatal(err)
+		}
+		start := time.Now()
+		hasher.StoreHashesFromDirs(dirs)
+		elapsed += time.Since(start)
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+	}
+
+	sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+	fmt.Printf("iterations:\t%d\n", *iterations)
+	fmt.Printf("images:\t%d\n", stats.images)
+	fmt.Printf("elapsed:\t%v\n", elapsed)
+	if elapsed > 0 {
+		fmt.Printf("images/sec:\t%.1f\n", float64(stats.images)/elapsed.Seconds())
+	}
+	fmt.Printf("commits:\t%d\n", stats.commits)
+	fmt.Printf("commit p50:\t%v\n", percentile(stats.latencies, 50))
+	fmt.Printf("commit p99:\t%v\n", percentile(stats.latencies, 99))
+	fmt.Printf("retries:\t%d\n", stats.retries)
+	fmt.Printf("failed commits:\t%d\n", stats.failures)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pyrovski/phash"
+)
+
+// compare prints the distance between two hex hashes without using a DB.
+func compare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s compare hashA hashB\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Print the Hamming distance and similarity of two hex hashes of equal length.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var hashes [2][]byte
+	for i, s := range fs.Args() {
+		h, err := hex.DecodeString(s)
+		if err != nil {
+			log.Fatalf("hash %q: %v", s, err)
+		}
+		hashes[i] = h
+	}
+	if len(hashes[0]) != len(hashes[1]) {
+		log.Fatalf("hashes differ in length: %d and %d bytes", len(hashes[0]), len(hashes[1]))
+	}
+	fmt.Printf("distance:   %d/%d bits\n", phash.HammingDistance(hashes[0], hashes[1]), len(hashes[0])*8)
+	fmt.Printf("similarity: %.4f\n", phash.Similarity(hashes[0], hashes[1]))
+}
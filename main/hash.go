@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pyrovski/phash"
+)
+
+// hash prints the hash of each file named in 'args' without using a DB.
+func hash(args []string) {
+	fs := flag.NewFlagSet("hash", flag.ExitOnError)
+	grayscale := fs.String("grayscale", "luma", "how to reduce color images to grayscale: luma, average, blue, green, or red")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s hash [flags] file...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Print the dimensions, raw bytes, stored words, and hex of each file's hash.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	grayMode, err := phash.ParseGrayscaleMode(*grayscale)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := phash.CheckHashSupport(); err != nil {
+		log.Fatal(err)
+	}
+
+	hasher := phash.PHasher{Grayscale: grayMode}
+	failed := false
+	for _, p := range fs.Args() {
+		fh, err := hasher.InspectFile(p)
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s\n", p)
+		fmt.Printf("  size:  %dx%d\n", fh.Width, fh.Height)
+		fmt.Printf("  bytes: %v\n", fh.Hash)
+		fmt.Printf("  words: %v\n", fh.Words)
+		fmt.Printf("  hex:   %s\n", hex.EncodeToString(fh.Hash))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pyrovski/phash"
+)
+
+// ingest stores hashes written by -emit, read from a file or stdin.
+func ingest(args []string) {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	dbFile := fs.String("db", "", "sqlite3 DB file")
+	batchSize := fs.Int("batch-size", 0, "frames per commit; 0 for the default")
+	dbTimeout := fs.Duration("dbtimeout", 30*time.Second, "how long to retry commits while the DB is locked")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s ingest [flags] [file]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Store hashes written by -emit, read from 'file' or stdin.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dbFile == "" {
+		log.Fatalf("must set --db")
+	}
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	hasher := phash.PHasher{DBFile: *dbFile, BatchSize: *batchSize, DBTimeout: *dbTimeout}
+	if _, err := hasher.IngestResults(r); err != nil {
+		log.Fatal(err)
+	}
+}
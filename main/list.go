@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pyrovski/phash"
+)
+
+// list prints the keys stored in a DB.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dbFile := fs.String("db", "", "sqlite3 DB file")
+	table := fs.String("table", "", "hash table in the DB; key_hashes if empty")
+	prefix := fs.String("prefix", "", "only list keys starting with this prefix")
+	counts := fs.Bool("counts", false, "print the number of frames for each key")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s list [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dbFile == "" {
+		log.Fatalf("must set --db")
+	}
+
+	hasher := phash.PHasher{DBFile: *dbFile, Table: *table}
+	keys, err := hasher.KeyCounts(*prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, kc := range keys {
+		if *counts {
+			fmt.Printf("%v\t%v\n", kc.Key, kc.Frames)
+		} else {
+			fmt.Println(kc.Key)
+		}
+	}
+}
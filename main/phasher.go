@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"image"
+	"image/color"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -11,12 +19,74 @@ import (
 )
 
 var procs int
+var readProcs int
 var dbFile string
+var dbTemplate string
+var queryProcs int
+var keyPrefix string
+var checkDeterminism bool
+var slowestImages int
+var table string
+var lookupDBs string
 var keyFile string
+var keyFromDir bool
+var recursive bool
+var excludeDirs string
+var foldKeys bool
+var manifest string
 var dbTimeout time.Duration
+var queryTimeout time.Duration
+var flushInterval time.Duration
+var walCheckpointCommits int
+var walCheckpointInterval time.Duration
+var maxDist int
+var limit int
+var offset int
+var distanceMetric string
+var since string
+var startFrame int
+var endFrame int
+var sceneThreshold int
+var crop string
+var grayscale string
+var reduce int
+var minDimension int
 var query bool
 var show bool
+var emit bool
 var store bool
+var storeNew bool
+var hashFormat string
+var outputFormat string
+var onlyNew bool
+var importFile string
+var exportFile string
+var fromFile string
+var alphaBackground string
+var thumbnails bool
+var contentHashes bool
+var orientations bool
+var tiles int
+var scales string
+var anamorphic float64
+var logLevel string
+var quiet bool
+var cpuProfile string
+var memProfile string
+var synchronous string
+var initDB bool
+var force bool
+var lockWait time.Duration
+var commitRate float64
+var keyStreams bool
+var checkpoint string
+var conflict string
+var deterministic bool
+var pageSize int
+var clustered bool
+var cacheSize int
+var expectedFramesFile string
+var frameTolerance float64
 
 func bool2int(b bool) int {
 	if b {
@@ -25,38 +95,469 @@ func bool2int(b bool) int {
 	return 0
 }
 
+// readExpectedFrames reads "key,frames" lines from 'name'.
+func readExpectedFrames(name string) (map[string]int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, ",")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: expected key,frames: %q", name, line)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		result[line[:i]] = n
+	}
+	return result, scanner.Err()
+}
+
+// readPaths reads one path per line from 'name', skipping blank lines and
+// lines starting with '#'.
+func readPaths(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+// envFlags maps environment variables to the flags they set, for
+// deployments that can't easily pass flags. Flags given on the command line
+// take precedence.
+var envFlags = []struct{ env, flag string }{
+	{"PHASH_DB", "db"},
+	{"PHASH_TABLE", "table"},
+	{"PHASH_PROCS", "procs"},
+	{"PHASH_DBTIMEOUT", "dbtimeout"},
+	{"PHASH_QUERYTIMEOUT", "querytimeout"},
+	{"PHASH_MAXDIST", "maxdist"},
+	{"PHASH_DISTANCE", "distance"},
+}
+
+// setFlagsFromEnv sets flags from envFlags' variables that are set. It must
+// be called before flag.Parse so command-line flags override them.
+func setFlagsFromEnv() {
+	for _, e := range envFlags {
+		v, ok := os.LookupEnv(e.env)
+		if !ok {
+			continue
+		}
+		if err := flag.Set(e.flag, v); err != nil {
+			log.Fatalf("invalid %s %q: %v", e.env, v, err)
+		}
+	}
+}
+
+// parseCrop parses a -crop value, x0,y0,x1,y1, exiting if it's invalid. An
+// empty value is an empty rectangle.
+func parseCrop(s string) image.Rectangle {
+	var r image.Rectangle
+	if s == "" {
+		return r
+	}
+	if _, err := fmt.Sscanf(s, "%d,%d,%d,%d", &r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y); err != nil {
+		log.Fatalf("invalid -crop %q: %v", s, err)
+	}
+	return r.Canon()
+}
+
+// splitList splits a comma-separated list, returning nil for an empty one.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// confirm asks a yes/no question if stdin is a terminal, returning false
+// otherwise.
+func confirm(question string) bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func main() {
-	args := os.Args[1:]
-	if len(args) < 1 {
-		log.Fatalf("must provide one or more path arguments")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "list":
+			list(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		case "rehash":
+			rehash(os.Args[2:])
+			return
+		case "hash":
+			hash(os.Args[2:])
+			return
+		case "ingest":
+			ingest(os.Args[2:])
+			return
+		case "rekey":
+			rekey(os.Args[2:])
+			return
+		case "compare":
+			compare(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s (-show | -emit | -query | -store | -store-new) [flags] [dir...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -query [flags] -   (read image paths from stdin)\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s (-import | -export) file [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s (bench | list | verify | rehash | rekey) [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s hash [flags] file...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s compare hashA hashB\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s ingest [flags] [file]   (store the output of -emit)\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Environment variables, overridden by flags:\n")
+		for _, e := range envFlags {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\tsets -%s\n", e.env, e.flag)
+		}
 	}
 	flag.IntVar(&procs, "procs", 1, "# of goroutines for processing hashes")
+	flag.IntVar(&readProcs, "read-procs", 0, "# of paths to read at once; lower it if you hit the open file limit; 0 for one per CPU")
 	flag.StringVar(&dbFile, "db", "", "sqlite3 DB file")
+	flag.StringVar(&table, "table", "", "hash table name, to keep several indexes in one DB; default key_hashes")
+	flag.StringVar(&dbTemplate, "db-template", "", "store each key in its own sqlite3 DB named by this template, e.g. db/{key}.sqlite; queries search all of them")
+	flag.IntVar(&queryProcs, "query-procs", 0, "with -db-template, # of shards to query at once; 0 for one per CPU")
+	flag.StringVar(&keyPrefix, "key-prefix", "", "with -db-template, only query shards of keys starting with this")
+	flag.StringVar(&lookupDBs, "lookup-dbs", "", "comma-separated sqlite3 DB files to also search with -query")
 	flag.StringVar(&keyFile, "keyfile", "", "read each directory's key from this filename in the directory")
+	flag.StringVar(&manifest, "manifest", "", "CSV (pattern,key) or JSON manifest assigning keys to directories or filename patterns")
+	flag.BoolVar(&keyFromDir, "keyfromdir", false, "use each image's directory as its key")
+	flag.BoolVar(&recursive, "recursive", false, "also read images in subdirectories")
+	flag.StringVar(&excludeDirs, "exclude-dirs", "", "with -recursive, comma-separated glob patterns of directories to skip, e.g. .git,thumbs")
+	flag.BoolVar(&foldKeys, "fold-keys", false, "lower-case and NFC-normalize keys")
 	flag.DurationVar(&dbTimeout, "dbtimeout", time.Duration(30), "timeout for DB operations")
+	flag.DurationVar(&queryTimeout, "querytimeout", 0, "cancel individual lookups taking longer than this; 0 for no timeout")
+	flag.BoolVar(&keyStreams, "key-streams", false, "with -store, batch each key's frames separately so they commit together")
+	flag.Float64Var(&commitRate, "commit-rate", 0, "with -store, commit at most this many batches per second; 0 for no limit")
+	flag.DurationVar(&flushInterval, "flush-interval", 0, "with -store, also commit partial batches this often; 0 only commits full batches")
+	flag.IntVar(&walCheckpointCommits, "wal-checkpoint-commits", 0, "with -store on a WAL-mode DB, truncate the WAL after this many commits; 0 never")
+	flag.DurationVar(&walCheckpointInterval, "wal-checkpoint-interval", 0, "with -store on a WAL-mode DB, truncate the WAL this often; 0 never")
+	flag.IntVar(&maxDist, "maxdist", 0, "maximum Hamming distance for -query matches")
+	flag.IntVar(&limit, "limit", 0, "with -query, print at most this many matches per image, closest first; 0 for no limit")
+	flag.IntVar(&offset, "offset", 0, "with -query, skip this many matches per image before -limit")
+	flag.StringVar(&distanceMetric, "distance", "hamming", "distance metric for -maxdist: hamming, or native for OpenCV's BlockMeanHash.Compare")
+	flag.StringVar(&since, "since", "", "skip files modified before this RFC 3339 time")
+	flag.IntVar(&startFrame, "start-frame", 0, "skip frames numbered below this; 0 for no limit")
+	flag.IntVar(&endFrame, "end-frame", 0, "skip frames numbered above this; 0 for no limit")
+	flag.IntVar(&sceneThreshold, "scene-threshold", 0, "with -store, skip frames within this Hamming distance of the key's last stored frame; 0 disables")
+	flag.StringVar(&crop, "crop", "", "only hash this region of each image: x0,y0,x1,y1")
+	flag.StringVar(&grayscale, "grayscale", "luma", "how to reduce color images to grayscale: luma, average, blue, green, or red")
+	flag.IntVar(&reduce, "reduce", 1, "decode images at 1/reduce scale for speed: 1, 2, 4, or 8; queries must use the DB's factor")
+	flag.IntVar(&minDimension, "min-dimension", 0, "skip images narrower or shorter than this many pixels; 0 for the default (8), negative to disable")
 	flag.BoolVar(&query, "query", false, "query DB for input matches")
 	flag.BoolVar(&store, "store", false, "add entries to DB")
-	flag.BoolVar(&show, "show", true, "print hashes of input images")
+	flag.BoolVar(&storeNew, "store-new", false, "add entries to DB only if no stored frame is within -maxdist")
+	flag.BoolVar(&show, "show", false, "print hashes of input images")
+	flag.BoolVar(&emit, "emit", false, "write hashes of input images to stdout for the ingest command instead of storing them")
+	flag.StringVar(&fromFile, "from-file", "", "read additional path arguments from this file, one per line; lines starting with # are ignored")
+	flag.StringVar(&importFile, "import", "", "import path,hashhex lines from this file into DB; gzipped files are detected")
+	flag.StringVar(&exportFile, "export", "", "export key,frame,hashhex lines from DB to this file, gzipped if it ends in .gz")
+	flag.StringVar(&alphaBackground, "alpha-background", "black", "background for transparent PNG regions: black or white")
+	flag.StringVar(&synchronous, "synchronous", "", "SQLite synchronous pragma: OFF, NORMAL, or FULL (OFF risks DB corruption on crash)")
+	flag.StringVar(&expectedFramesFile, "expected-frames", "", "file of key,frames lines to validate stored frame counts against with -store")
+	flag.Float64Var(&frameTolerance, "frame-tolerance", 0, "allowed fractional deviation from -expected-frames")
+	flag.BoolVar(&orientations, "orientations", false, "also hash and match flipped and rotated copies of frames")
+	flag.IntVar(&tiles, "tiles", 0, "also hash an NxN grid of overlapping tiles of each frame so cropped copies match; multiplies DB size by up to N*N+1")
+	flag.BoolVar(&deterministic, "deterministic", false, "store and print images in read order regardless of -procs, so results are reproducible")
+	flag.BoolVar(&checkDeterminism, "check-determinism", false, "hash each image twice and drop those whose hashes differ; roughly doubles hashing time")
+	flag.IntVar(&slowestImages, "slowest", 0, "time hashing each frame and list this many of the slowest in the summary")
+	flag.StringVar(&conflict, "conflict", "ignore", "with -store, what to do with frames already stored with a different hash: ignore, update, or error")
+	flag.StringVar(&checkpoint, "checkpoint", "", "with -store, record committed frames in this file and skip them when restarted")
+	flag.DurationVar(&lockWait, "lock-wait", 0, "with -store, wait this long for another store into the same DB to finish; 0 fails immediately, negative waits indefinitely")
+	flag.Float64Var(&anamorphic, "anamorphic", 0, "also hash each frame with its width stretched by this pixel aspect ratio (e.g. 1.185), so anamorphic and display-corrected copies match")
+	flag.StringVar(&scales, "scales", "", "comma-separated scale factors (e.g. 0.5) to also hash each frame at, so resized copies match; multiplies DB size")
+	flag.BoolVar(&force, "force", false, "allow -store into a non-empty DB without -since")
+	flag.BoolVar(&initDB, "init", false, "create DB tables if they don't exist")
+	flag.IntVar(&pageSize, "page-size", 0, "SQLite page size in bytes for a new DB created with -init")
+	flag.BoolVar(&clustered, "clustered", false, "with -init, store each key's frames together in frame order (WITHOUT ROWID)")
+	flag.IntVar(&cacheSize, "cache-size", 0, "SQLite cache_size pragma (pages if positive, KiB if negative)")
+	flag.BoolVar(&thumbnails, "thumbnails", false, "store a small preview of each frame with -store")
+	flag.BoolVar(&contentHashes, "content-hashes", false, "store the SHA-256 of each frame file with -store, to detect byte-identical frames")
+	flag.StringVar(&logLevel, "loglevel", "info", "log verbosity: error, info, or debug")
+	flag.BoolVar(&quiet, "quiet", false, "only log errors; overrides -loglevel")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile to this file")
+	flag.StringVar(&memProfile, "memprofile", "", "write a heap profile to this file on exit")
+	flag.StringVar(&hashFormat, "output-hash-format", "decimal", "hash output format: decimal, hex, or base64")
+	flag.BoolVar(&onlyNew, "only-new", false, "with -query, print NEW or DUPLICATE for each image instead of its matches, using -maxdist as the threshold")
+	flag.StringVar(&outputFormat, "output-format", "text", "query output format: text, or tsv for distance<TAB>query<TAB>match<TAB>frame lines")
+	setFlagsFromEnv()
 	flag.Parse()
-	args = flag.Args()
+	args := flag.Args()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	if bool2int(store)+bool2int(query)+bool2int(show) != 1 {
-		log.Fatalf("must provide exactly one of -show, -query, -store")
+	if fromFile != "" {
+		paths, err := readPaths(fromFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, paths...)
+	}
+
+	doImport := importFile != ""
+	doExport := exportFile != ""
+	switch bool2int(store) + bool2int(storeNew) + bool2int(query) + bool2int(show) + bool2int(emit) + bool2int(doImport) + bool2int(doExport) {
+	case 0:
+		flag.Usage()
+		os.Exit(2)
+	case 1:
+	default:
+		log.Fatalf("must provide exactly one of -show, -emit, -query, -store, -store-new, -import, -export")
+	}
+	if !doImport && !doExport && len(args) < 1 {
+		log.Fatalf("must provide one or more path arguments")
 	}
 
-	if (query || store) && dbFile == "" {
+	if (store || storeNew) && dbFile == "" && dbTemplate == "" {
+		log.Fatalf("must set --db or --db-template")
+	}
+	if query && dbFile == "" && dbTemplate == "" && lookupDBs == "" {
+		log.Fatalf("must set --db, --db-template, or --lookup-dbs")
+	}
+	if (doImport || doExport) && dbFile == "" {
 		log.Fatalf("must set --db")
 	}
 
-	hasher := phash.PHasher{DBFile: dbFile, DBTimeout: dbTimeout, KeyFile: keyFile, HashProcs: procs}
+	format, err := phash.ParseHashFormat(hashFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	output, err := phash.ParseOutputFormat(outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conflictPolicy, err := phash.ParseConflictPolicy(conflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	level, err := phash.ParseLogLevel(logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metric, err := phash.ParseDistanceMetric(distanceMetric)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grayMode, err := phash.ParseGrayscaleMode(grayscale)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var background color.Color
+	switch alphaBackground {
+	case "black":
+		background = color.Black
+	case "white":
+		background = color.White
+	default:
+		log.Fatalf("unknown -alpha-background %q", alphaBackground)
+	}
+
+	var sinceTime time.Time
+	if since != "" {
+		sinceTime, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cropRect := parseCrop(crop)
+
+	var scaleFactors []float64
+	for _, s := range splitList(scales) {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f <= 0 {
+			log.Fatalf("invalid -scales factor %q", s)
+		}
+		scaleFactors = append(scaleFactors, f)
+	}
+
+	var expectedFrames map[string]int
+	if expectedFramesFile != "" {
+		expectedFrames, err = readExpectedFrames(expectedFramesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	hasher := phash.PHasher{
+		DBFile:                dbFile,
+		Table:                 table,
+		DBTemplate:            dbTemplate,
+		QueryProcs:            queryProcs,
+		KeyPrefix:             keyPrefix,
+		CheckDeterminism:      checkDeterminism,
+		SlowestImages:         slowestImages,
+		LookupDBs:             splitList(lookupDBs),
+		DBTimeout:             dbTimeout,
+		Synchronous:           synchronous,
+		PageSize:              pageSize,
+		Clustered:             clustered,
+		CacheSize:             cacheSize,
+		QueryTimeout:          queryTimeout,
+		FlushInterval:         flushInterval,
+		WALCheckpointCommits:  walCheckpointCommits,
+		WALCheckpointInterval: walCheckpointInterval,
+		MaxDistance:           maxDist,
+		Limit:                 limit,
+		Offset:                offset,
+		DistanceMetric:        metric,
+		Since:                 sinceTime,
+		StartFrame:            startFrame,
+		EndFrame:              endFrame,
+		SceneThreshold:        sceneThreshold,
+		CropRect:              cropRect,
+		MinDimension:          minDimension,
+		Grayscale:             grayMode,
+		Reduce:                reduce,
+		Force:                 force,
+		LockWait:              lockWait,
+		CommitRate:            commitRate,
+		KeyStreams:            keyStreams,
+		Checkpoint:            checkpoint,
+		Conflict:              conflictPolicy,
+		Deterministic:         deterministic,
+		KeyFile:               keyFile,
+		KeyFromDir:            keyFromDir,
+		FoldKeys:              foldKeys,
+		Recursive:             recursive,
+		ExcludeDirs:           splitList(excludeDirs),
+		Manifest:              manifest,
+		HashProcs:             procs,
+		ReadProcs:             readProcs,
+		HashFormat:            format,
+		OutputFormat:          output,
+		OnlyNew:               onlyNew,
+		LogLevel:              level,
+		Quiet:                 quiet,
+		AlphaBackground:       background,
+		StoreThumbnails:       thumbnails,
+		StoreContentHashes:    contentHashes,
+		Orientations:          orientations,
+		Anamorphic:            anamorphic,
+		Tiles:                 tiles,
+		Scales:                scaleFactors,
+		ExpectedFrames:        expectedFrames,
+		FrameTolerance:        frameTolerance,
+	}
+	if initDB {
+		if err := hasher.InitDB(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if store && !force && sinceTime.IsZero() && dbTemplate == "" {
+		n, err := hasher.RowCount()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n > 0 {
+			if !confirm(fmt.Sprintf("DB %q already has %d rows; store anyway?", dbFile, n)) {
+				log.Fatalf("DB %q already has %d rows; use -force to store anyway, or -since for an incremental store", dbFile, n)
+			}
+			hasher.Force = true
+		}
+	}
+
+	stopProfiles := startProfiles(cpuProfile, memProfile)
+	defer stopProfiles()
+	// fatal stops profiling before exiting, since log.Fatal skips deferred
+	// calls.
+	fatal := func(v ...interface{}) {
+		stopProfiles()
+		log.Fatal(v...)
+	}
+
+	// The first interrupt stops reading input and lets pending commits
+	// finish; a second one exits immediately.
+	sigC := make(chan os.Signal, 2)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigC
+		log.Print("interrupted; flushing pending work (interrupt again to abort)")
+		hasher.Stop()
+		<-sigC
+		stopProfiles()
+		os.Exit(1)
+	}()
+
 	if query {
-		hasher.LookupHashesInDirs(args)
+		if len(args) == 1 && args[0] == "-" {
+			hasher.LookupPaths(os.Stdin)
+		} else {
+			hasher.LookupHashesInDirs(args)
+		}
 	}
 	if store {
 		hasher.StoreHashesFromDirs(args)
 	}
+	if storeNew {
+		hasher.StoreNewHashesFromDirs(args)
+	}
 	if show {
 		hasher.PrintHashesInDirs(args)
 	}
+	if emit {
+		hasher.EmitHashesInDirs(args, os.Stdout)
+	}
+	if doImport {
+		f, err := os.Open(importFile)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		if _, err := hasher.ImportHashes(f); err != nil {
+			fatal(err)
+		}
+	}
+	if doExport {
+		f, err := os.Create(exportFile)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err := hasher.ExportHashes(f, strings.HasSuffix(exportFile, ".gz")); err != nil {
+			fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			fatal(err)
+		}
+	}
 }
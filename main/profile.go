@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+// startProfiles starts a CPU profile written to 'cpuFile', if set, and
+// returns a function that stops it and writes a heap profile to 'memFile',
+// if set. The returned function only does anything the first time it's
+// called.
+func startProfiles(cpuFile, memFile string) func() {
+	var cpu *os.File
+	if cpuFile != "" {
+		f, err := os.Create(cpuFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+		cpu = f
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if cpu != nil {
+				pprof.StopCPUProfile()
+				if err := cpu.Close(); err != nil {
+					log.Print(err)
+				}
+			}
+			if memFile != "" {
+				f, err := os.Create(memFile)
+				if err != nil {
+					log.Print(err)
+					return
+				}
+				defer f.Close()
+				runtime.GC()
+				if err := pprof.WriteHeapProfile(f); err != nil {
+					log.Print(err)
+				}
+			}
+		})
+	}
+}
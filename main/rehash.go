@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pyrovski/phash"
+)
+
+// rehash recomputes stored hashes from stored thumbnails, or from the
+// original images grouped by content hash.
+func rehash(args []string) {
+	fs := flag.NewFlagSet("rehash", flag.ExitOnError)
+	dbFile := fs.String("db", "", "sqlite3 DB file")
+	table := fs.String("table", "", "hash table in the DB; key_hashes if empty")
+	byContent := fs.Bool("by-content", false, "recompute hashes from the images in the given directories, hashing byte-identical files once (requires stored content hashes)")
+	recursive := fs.Bool("recursive", false, "with -by-content, also read subdirectories")
+	keyFile := fs.String("keyfile", "", "with -by-content, read each directory's key from this filename in the directory")
+	keyFromDir := fs.Bool("keyfromdir", false, "with -by-content, use each image's directory as its key")
+	manifest := fs.String("manifest", "", "with -by-content, CSV (pattern,key) or JSON manifest assigning keys to directories or filename patterns")
+	foldKeys := fs.Bool("fold-keys", false, "with -by-content, lower-case and NFC-normalize keys")
+	crop := fs.String("crop", "", "with -by-content, only hash this region of each image: x0,y0,x1,y1; must match the DB")
+	grayscale := fs.String("grayscale", "luma", "with -by-content, how to reduce color images to grayscale; must match the DB")
+	reduce := fs.Int("reduce", 1, "with -by-content, decode images at 1/reduce scale; must match the DB")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s rehash [flags] [dir...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Recompute hashes from stored thumbnails. Thumbnail hashes only approximate\nthe original hashes; rehashed frames are listed in the rehashed_frames table.\nWith -by-content, recompute hashes from the images in each dir instead.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dbFile == "" {
+		log.Fatalf("must set --db")
+	}
+
+	hasher := phash.PHasher{DBFile: *dbFile, Table: *table}
+	if *byContent {
+		if fs.NArg() == 0 {
+			log.Fatalf("-by-content requires at least one dir")
+		}
+		grayMode, err := phash.ParseGrayscaleMode(*grayscale)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hasher.Recursive = *recursive
+		hasher.KeyFile = *keyFile
+		hasher.KeyFromDir = *keyFromDir
+		hasher.Manifest = *manifest
+		hasher.FoldKeys = *foldKeys
+		hasher.CropRect = parseCrop(*crop)
+		hasher.Grayscale = grayMode
+		hasher.Reduce = *reduce
+		n, err := hasher.RehashByContent(fs.Args()...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("rehashed %d frames from images", n)
+		return
+	}
+	n, err := hasher.RehashThumbnails()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("rehashed %d frames from thumbnails", n)
+}
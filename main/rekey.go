@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pyrovski/phash"
+)
+
+// rekey recomputes stored keys under a new key mode.
+func rekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	dbFile := fs.String("db", "", "sqlite3 DB file")
+	table := fs.String("table", "", "hash table in the DB; key_hashes if empty")
+	mode := fs.String("mode", "keep", "key mode: keep, or dir to key frames by their directory")
+	foldKeys := fs.Bool("fold-keys", false, "lower-case and NFC-normalize keys")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s rekey [flags]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Recompute the keys of stored frames from their current keys, without\nrereading images.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dbFile == "" {
+		log.Fatalf("must set --db")
+	}
+	keyMode, err := phash.ParseKeyMode(*mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hasher := phash.PHasher{DBFile: *dbFile, Table: *table, FoldKeys: *foldKeys}
+	n, err := hasher.Rekey(keyMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("rekeyed %d keys", n)
+}
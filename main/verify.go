@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pyrovski/phash"
+)
+
+// verify checks a DB and prints any problems, exiting nonzero if there are
+// any.
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dbFile := fs.String("db", "", "sqlite3 DB file")
+	table := fs.String("table", "", "hash table in the DB; key_hashes if empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s verify [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dbFile == "" {
+		log.Fatalf("must set --db")
+	}
+
+	hasher := phash.PHasher{DBFile: *dbFile, Table: *table}
+	report, err := hasher.Verify()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, msg := range report.Integrity {
+		fmt.Printf("integrity:\t%v\n", msg)
+	}
+	for _, f := range report.ZeroHashes {
+		fmt.Printf("zero hash:\t%v\t%v\n", f.Key, f.Frame)
+	}
+	if report.NullRows > 0 {
+		fmt.Printf("null rows:\t%v\n", report.NullRows)
+	}
+	for _, f := range report.DuplicateFrames {
+		fmt.Printf("duplicate:\t%v\t%v\n", f.Key, f.Frame)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
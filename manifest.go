@@ -0,0 +1,101 @@
+package phash
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestEntry maps images to a key. Pattern is either a directory, which
+// matches images directly in it, or a path.Match glob matched against each
+// image's full path and filename. Metadata, which can only be set in JSON
+// manifests, is stored with each matching frame.
+type ManifestEntry struct {
+	Pattern  string            `json:"pattern"`
+	Key      string            `json:"key"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// readManifest reads manifest entries from 'name'. Files ending in ".json"
+// hold a JSON array of entries; others hold "pattern,key" lines, with blank
+// lines and lines starting with '#' ignored.
+func readManifest(name string) ([]ManifestEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ManifestEntry
+	if strings.ToLower(path.Ext(name)) == ".json" {
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			i := strings.LastIndex(text, ",")
+			if i < 0 {
+				return nil, fmt.Errorf("%s:%d: expected pattern,key", name, line)
+			}
+			entries = append(entries, ManifestEntry{Pattern: text[:i], Key: text[i+1:]})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range entries {
+		if _, err := path.Match(e.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %q: %v", name, e.Pattern, err)
+		}
+		if e.Key == "" {
+			return nil, fmt.Errorf("%s: empty key for pattern %q", name, e.Pattern)
+		}
+	}
+	return entries, nil
+}
+
+// loadManifest reads Manifest, if set, for use by manifestEntry.
+func (h *PHasher) loadManifest() error {
+	h.manifest = nil
+	if h.Manifest == "" {
+		return nil
+	}
+	entries, err := readManifest(h.Manifest)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].Pattern = filepath.ToSlash(entries[i].Pattern)
+		entries[i].Key = h.normalizeKey(filepath.ToSlash(entries[i].Key))
+	}
+	h.manifest = entries
+	return nil
+}
+
+// manifestEntry returns the first manifest entry matching the image at
+// 'fullPath' in directory 'dir'.
+func (h *PHasher) manifestEntry(dir, fullPath string) (ManifestEntry, bool) {
+	dir = path.Clean(dir)
+	name := path.Base(fullPath)
+	for _, e := range h.manifest {
+		if path.Clean(e.Pattern) == dir {
+			return e, true
+		}
+		if ok, _ := path.Match(e.Pattern, fullPath); ok {
+			return e, true
+		}
+		if ok, _ := path.Match(e.Pattern, name); ok {
+			return e, true
+		}
+	}
+	return ManifestEntry{}, false
+}
@@ -0,0 +1,67 @@
+package phash
+
+import "sync"
+
+// Match is a stored frame matching a query hash.
+type Match struct {
+	// Query is the path of the query image, if any.
+	Query string
+	Key   string
+	Frame int
+	// Path is the path of the matched image, if known.
+	Path string
+	// Distance is the Hamming distance between the query and stored hashes.
+	Distance int
+	// Metadata is the metadata stored with the matched frame, if any.
+	Metadata map[string]string
+}
+
+// QueryResult is the result of looking up a single query image.
+type QueryResult struct {
+	// Path is the path of the query image.
+	Path string
+	Hash []byte
+	// Matches are the stored frames matching Hash.
+	Matches []Match
+	// Total is the number of matches before Limit and Offset were applied.
+	Total int
+	// Err is set if the lookup failed.
+	Err error
+}
+
+// IsNew reports whether the query image matched no stored frame, i.e. it
+// would be kept by a deduplicating import.
+func (r QueryResult) IsNew() bool {
+	return r.Err == nil && r.Total == 0 && len(r.Matches) == 0
+}
+
+// Class returns "NEW" or "DUPLICATE" for a successful lookup.
+func (r QueryResult) Class() string {
+	if r.IsNew() {
+		return "NEW"
+	}
+	return "DUPLICATE"
+}
+
+// LookupStream looks up images in 'paths' like LookupHashesInDirs, but sends
+// each image's result on the returned channel as soon as its lookup finishes
+// instead of printing it. The channel is closed when all images have been
+// looked up; the caller must drain it.
+func (h *PHasher) LookupStream(paths []string) (<-chan QueryResult, error) {
+	if err := CheckHashSupport(); err != nil {
+		return nil, err
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan QueryResult)
+	go func() {
+		defer close(out)
+		defer release()
+		h.runPipeline(paths, func(dbC chan *image, wg *sync.WaitGroup, stats *runStats) {
+			h.lookupHashes(dbC, st, wg, stats, func(r QueryResult) { out <- r })
+		})
+	}()
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package phash
+
+import (
+	"context"
+	"sync"
+)
+
+// Matcher matches hashes against a Store and adds hashes to it, independent
+// of where the hashes come from. Added hashes are buffered until Flush, and
+// Query matches them as well as stored ones. A Matcher is safe for
+// concurrent use.
+type Matcher struct {
+	// BatchSize, if positive, flushes automatically once this many hashes
+	// are buffered.
+	BatchSize int
+
+	st      Store
+	mu      sync.RWMutex
+	pending []Result
+	index   *MemStore
+}
+
+// NewMatcher returns a Matcher on 'st', e.g. a SQLiteStore or a MemStore.
+func NewMatcher(st Store) *Matcher {
+	return &Matcher{st: st, index: NewMemStore()}
+}
+
+// NewMatcher returns a Matcher on the PHasher's store (see openStore) and a
+// function to release it. Buffered hashes are not flushed on release.
+func (h *PHasher) NewMatcher() (*Matcher, func(), error) {
+	st, release, err := h.openStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	m := NewMatcher(st)
+	m.BatchSize = h.batchSize()
+	return m, release, nil
+}
+
+// Add buffers the hash of frame 'frame' of 'key' to be stored.
+func (m *Matcher) Add(key string, frame int, hash []byte) error {
+	return m.add(Result{Key: key, Frame: frame, Hash: hash})
+}
+
+// add buffers 'r', flushing if BatchSize is reached.
+func (m *Matcher) add(r Result) error {
+	m.mu.Lock()
+	m.pending = append(m.pending, r)
+	m.index.Insert([]Result{r})
+	full := m.BatchSize > 0 && len(m.pending) >= m.BatchSize
+	m.mu.Unlock()
+	if full {
+		return m.Flush()
+	}
+	return nil
+}
+
+// Query returns stored and buffered frames within Hamming distance
+// 'maxDist' of 'hash'.
+func (m *Matcher) Query(hash []byte, maxDist int) ([]Match, error) {
+	return m.QueryContext(context.Background(), hash, maxDist)
+}
+
+// QueryContext is like Query, but stops if 'ctx' is done.
+func (m *Matcher) QueryContext(ctx context.Context, hash []byte, maxDist int) ([]Match, error) {
+	// Hold mu across both lookups, so a concurrent flush can't move buffered
+	// hashes into the store between them.
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matches, err := m.st.Lookup(ctx, hash, maxDist)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := m.index.Lookup(ctx, hash, maxDist)
+	return append(matches, pending...), err
+}
+
+// Flush stores the buffered hashes.
+func (m *Matcher) Flush() error {
+	_, err := m.flush()
+	return err
+}
+
+// flush stores the buffered hashes, returning the number stored. They stay
+// buffered if storing fails.
+func (m *Matcher) flush() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) == 0 {
+		return 0, nil
+	}
+	n, err := m.st.Insert(m.pending)
+	if err != nil {
+		return n, err
+	}
+	m.pending = nil
+	m.index = NewMemStore()
+	return n, nil
+}
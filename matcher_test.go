@@ -0,0 +1,48 @@
+package phash
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// slowStore is a MemStore whose lookups signal 'looked' and take a while
+// to return, to widen races with concurrent inserts.
+type slowStore struct {
+	*MemStore
+	looked chan struct{}
+}
+
+func (s slowStore) Lookup(ctx context.Context, hash []byte, maxDist int) ([]Match, error) {
+	matches, err := s.MemStore.Lookup(ctx, hash, maxDist)
+	s.looked <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	return matches, err
+}
+
+func TestMatcherQueryDuringFlush(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	hash := testHash(1)
+	st := slowStore{NewMemStore(), make(chan struct{}, 1)}
+	m := NewMatcher(st)
+	if err := m.Add("a", 1, hash); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []Match)
+	go func() {
+		matches, err := m.Query(hash, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- matches
+	}()
+	<-st.looked
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if matches := <-done; len(matches) != 1 {
+		t.Errorf("got matches %+v during a flush, want one", matches)
+	}
+}
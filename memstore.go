@@ -0,0 +1,85 @@
+package phash
+
+import (
+	"context"
+	"sync"
+)
+
+// frameID identifies a stored frame.
+type frameID struct {
+	key   string
+	frame int
+}
+
+// MemStore is an in-memory Store backed by a BK-tree. It's only persisted
+// by Save.
+type MemStore struct {
+	mu     sync.RWMutex
+	tree   bkTree
+	frames map[frameID]bool
+	// hashBytes, if positive, truncates stored and query hashes to this
+	// length, to match hashes loaded from a DB by BuildIndex.
+	hashBytes int
+	// source identifies the DB contents the store was built from, if any.
+	source indexSource
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{frames: make(map[frameID]bool)}
+}
+
+// Init does nothing.
+func (s *MemStore) Init() error { return nil }
+
+// Insert adds 'results' and their variants to the index. Frames whose (key,
+// frame) is already stored are ignored.
+func (s *MemStore) Insert(results []Result) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := 0
+	for _, r := range results {
+		id := frameID{r.Key, r.Frame}
+		if s.frames[id] {
+			continue
+		}
+		s.add(bkEntry{hash: r.Hash, key: r.Key, frame: r.Frame, path: r.Path, metadata: r.Metadata}, false)
+		for _, v := range r.Variants {
+			s.add(bkEntry{hash: v.Hash, key: r.Key, frame: r.Frame, path: r.Path, metadata: r.Metadata}, true)
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// add adds 'e' to the tree, recording its frame unless it's a variant.
+// The caller must hold mu for writing.
+func (s *MemStore) add(e bkEntry, variant bool) {
+	if !variant {
+		s.frames[frameID{e.key, e.frame}] = true
+	}
+	e.hash = s.truncate(e.hash)
+	e.variant = variant
+	s.tree.add(e)
+}
+
+// truncate returns 'hash' truncated to hashBytes, if it's set.
+func (s *MemStore) truncate(hash []byte) []byte {
+	if s.hashBytes > 0 && len(hash) > s.hashBytes {
+		return hash[:s.hashBytes]
+	}
+	return hash
+}
+
+// Lookup returns stored frames within Hamming distance 'maxDist' of 'hash'.
+// A frame matching through several variants is returned once, at its
+// closest distance.
+func (s *MemStore) Lookup(ctx context.Context, hash []byte, maxDist int) ([]Match, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches []Match
+	s.tree.lookup(s.truncate(hash), maxDist, func(e bkEntry, dist int) {
+		matches = append(matches, Match{Key: e.key, Frame: e.frame, Path: e.path, Distance: dist, Metadata: e.metadata})
+	})
+	return mergeMatches(nil, matches), ctx.Err()
+}
@@ -0,0 +1,35 @@
+package phash
+
+import (
+	"context"
+	"testing"
+)
+
+// flipBit returns a copy of 'hash' with bit 'i' flipped.
+func flipBit(hash []byte, i int) []byte {
+	hash = append([]byte(nil), hash...)
+	hash[i/8] ^= 1 << uint(i%8)
+	return hash
+}
+
+func TestMemStoreLookupMergesVariants(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	s := NewMemStore()
+	hash := testHash(1)
+	_, err := s.Insert([]Result{{Key: "a", Frame: 1, Hash: hash, Variants: []Variant{
+		{Name: "flip", Hash: flipBit(hash, 0)},
+		{Name: "rot180", Hash: flipBit(flipBit(hash, 0), 1)},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := s.Lookup(context.Background(), flipBit(hash, 0), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Distance != 0 {
+		t.Errorf("got matches %+v, want frame a 1 once at distance 0", matches)
+	}
+}
@@ -0,0 +1,72 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+)
+
+// keyedTables are the tables holding per-frame rows keyed by fullpath.
+var keyedTables = []string{"key_hashes", "key_hash_variants", "thumbnails", "content_hashes", "frame_metadata", "rehashed_frames"}
+
+const tableExistsQuery = "select count(*) from sqlite_master where type = 'table' and name = ?"
+
+// MergeKeys reassigns all frames of the 'src' keys to 'dst' in a single
+// transaction, e.g. after finding that two paths hold the same video.
+//
+// Frames keep their numbers. If 'dst' already has a frame with the same
+// number, 'dst's frame is kept and the src frame is dropped, along with its
+// variants, thumbnail, content hash, and metadata; likewise, among 'src'
+// keys, earlier ones take precedence over later ones.
+func (h *PHasher) MergeKeys(dst string, src ...string) error {
+	if dst == "" {
+		return errors.New("empty destination key")
+	}
+	dst = h.normalizeKey(dst)
+	db, err := h.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var tables []string
+	for _, table := range keyedTables {
+		table = h.tableQuery(table)
+		var n int
+		if err := tx.QueryRow(tableExistsQuery, table).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			tables = append(tables, table)
+		}
+	}
+	// Collisions are decided by 'key_hashes' alone, and colliding frames are
+	// dropped from every table, so a kept frame never gets another frame's
+	// variants or metadata, and a moved frame keeps all of its rows.
+	collisions := fmt.Sprintf("fullpath = ? and frame in (select frame from %s where fullpath = ?)", h.tableQuery(defaultTable))
+	for _, key := range src {
+		key = h.normalizeKey(key)
+		if key == dst {
+			continue
+		}
+		for _, table := range tables {
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s where %s", table, collisions), key, dst); err != nil {
+				return err
+			}
+		}
+		for _, table := range tables {
+			// OR IGNORE leaves rows colliding with stray rows of 'dst' frames
+			// that have no hash; drop them.
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE OR IGNORE %s SET fullpath = ? where fullpath = ?", table), dst, key); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s where fullpath = ?", table), key); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,73 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// tableRows returns "key frame" for each row of 'table' in 'dbFile'.
+func tableRows(t *testing.T, dbFile, table string) []string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select fullpath || ' ' || frame from " + table + " order by fullpath, frame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMergeKeysDropsCollidingFrames(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := testDB(t,
+		Result{Key: "dst", Frame: 1, Hash: testHash(1)},
+		Result{Key: "src", Frame: 1, Hash: testHash(2), Variants: []Variant{{Name: "flip", Hash: testHash(3)}}, Metadata: map[string]string{"a": "b"}},
+		Result{Key: "src", Frame: 2, Hash: testHash(4), Variants: []Variant{{Name: "flip", Hash: testHash(5)}}},
+	)
+	if err := h.MergeKeys("dst", "src"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"key_hashes":        {"dst 1", "dst 2"},
+		"key_hash_variants": {"dst 2"},
+		"frame_metadata":    nil,
+	}
+	for table, rows := range want {
+		if got := tableRows(t, h.DBFile, table); !reflect.DeepEqual(got, rows) {
+			t.Errorf("%s: got rows %q, want %q", table, got, rows)
+		}
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	matches, err := st.Lookup(context.Background(), testHash(1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Key != "dst" || matches[0].Frame != 1 {
+		t.Errorf("got matches %+v for dst's frame 1", matches)
+	}
+}
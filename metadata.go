@@ -0,0 +1,79 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// createMetadataQuery creates the 'frame_metadata' table used by InitDB. Rows
+// hold arbitrary name/value pairs attached to stored frames.
+const createMetadataQuery = "CREATE TABLE IF NOT EXISTS frame_metadata(fullpath text, frame integer, name text, value text, UNIQUE(fullpath, frame, name))"
+const insertMetadataQuery = "INSERT INTO frame_metadata(fullpath, frame, name, value) values(?,?,?,?)"
+const lookupMetadataQuery = "select name, value from frame_metadata where fullpath = ? and frame = ?"
+
+// frameMetadata returns the metadata to store for 'img': 'manifest', the
+// metadata of its manifest entry, overridden by the result of the Metadata
+// callback. It returns nil if there's none.
+func (h *PHasher) frameMetadata(manifest map[string]string, img *image) map[string]string {
+	var extra map[string]string
+	if h.Metadata != nil {
+		extra = h.Metadata(img.path, img.key, img.frame)
+	}
+	if len(manifest) == 0 && len(extra) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(manifest)+len(extra))
+	for name, value := range manifest {
+		result[name] = value
+	}
+	for name, value := range extra {
+		result[name] = value
+	}
+	return result
+}
+
+// addMetadata sets the Metadata of each of 'matches' from the
+// 'frame_metadata' table, if it exists.
+func (s *SQLiteStore) addMetadata(ctx context.Context, matches []Match) error {
+	if len(matches) == 0 {
+		return nil
+	}
+	stmt, err := s.stmt(ctx, lookupMetadataQuery)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := range matches {
+		md, err := scanMetadata(ctx, stmt, matches[i].Key, matches[i].Frame)
+		if err != nil {
+			return err
+		}
+		matches[i].Metadata = md
+	}
+	return nil
+}
+
+// scanMetadata returns the metadata of a frame using 'stmt', a prepared
+// lookupMetadataQuery.
+func scanMetadata(ctx context.Context, stmt *sql.Stmt, key string, frame int) (map[string]string, error) {
+	rows, err := stmt.QueryContext(ctx, key, frame)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var md map[string]string
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if md == nil {
+			md = make(map[string]string)
+		}
+		md[name] = value
+	}
+	return md, rows.Err()
+}
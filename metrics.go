@@ -0,0 +1,18 @@
+package phash
+
+import "time"
+
+// Metrics holds optional hooks called by the pipeline. Nil hooks are skipped.
+// Hooks may be called concurrently.
+type Metrics struct {
+	// Commit is called once per batch after all retries with the number of
+	// images in the batch, the total time spent committing, the number of
+	// retries due to a locked DB, and the final error, if any.
+	Commit func(images int, latency time.Duration, retries int, err error)
+}
+
+func (m *Metrics) commit(images int, latency time.Duration, retries int, err error) {
+	if m.Commit != nil {
+		m.Commit(images, latency, retries, err)
+	}
+}
@@ -0,0 +1,291 @@
+package phash
+
+import (
+	"bytes"
+	"fmt"
+	stdimage "image"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// isMultiFrame reports whether 'name' is a container that may hold several
+// frames: an animated GIF, a multi-page TIFF, or, if built with the "pdf"
+// tag, a PDF.
+func isMultiFrame(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gif", ".tif", ".tiff":
+		return true
+	case ".pdf":
+		return pdfSupported
+	}
+	return false
+}
+
+// containerFrameRe matches containers named like frame images. Those with a
+// single page are frames of a sequence, e.g. one TIFF per frame, rather than
+// sequences themselves.
+var containerFrameRe = regexp.MustCompile("(.*)-([0-9]+)[.](gif|tif|tiff|pdf)$")
+
+// pageRange returns the pages of a container holding the frames within
+// StartFrame and EndFrame, when its pages are numbered from 'first', as the
+// 0-based first page and a count, which is negative if there's no limit.
+func (h *PHasher) pageRange(first int) (start, count int) {
+	if h.StartFrame > first {
+		start = h.StartFrame - first
+	}
+	count = -1
+	if h.EndFrame > 0 {
+		count = h.EndFrame - first + 1 - start
+		if count < 0 {
+			count = 0
+		}
+	}
+	return start, count
+}
+
+// readFrames reads 'count' frames of the container at 'p' as grayscale,
+// starting with frame 'start' (from 0), or every frame from 'start' if count
+// is negative. Other frames aren't decoded, as far as the format allows. It
+// returns an error if the container has no frames, but not if it just has
+// none in the range. The caller must close the results.
+func (h *PHasher) readFrames(p string, start, count int) ([]gocv.Mat, error) {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".gif":
+		return h.readGIFFrames(p, start, count)
+	case ".pdf":
+		return h.readPDFPages(p, start, count)
+	}
+	flags := gocv.IMReadColor
+	if h.Grayscale == GrayLuma {
+		flags = gocv.IMReadGrayScale
+	}
+	var frames []gocv.Mat
+	if start == 0 && count < 0 {
+		frames = gocv.IMReadMulti(p, flags)
+	} else {
+		if count < 0 {
+			count = math.MaxInt32 - start
+		}
+		frames = gocv.IMReadMulti_WithParams(p, start, count, flags)
+	}
+	if len(frames) == 0 && start == 0 {
+		return nil, fmt.Errorf("%q: %v", p, ErrEmptyImage)
+	}
+	if h.Grayscale == GrayLuma {
+		return frames, nil
+	}
+	for i, frame := range frames {
+		frames[i] = h.toGray(frame)
+		frame.Close()
+	}
+	return frames, nil
+}
+
+// readGIFFrames reads frames of an animated GIF as grayscale, as in
+// readFrames. OpenCV can't decode GIFs, so they're decoded with image/gif.
+// Each frame is composited onto the previous ones according to its disposal
+// method, as a viewer would show it, and transparent regions are flattened
+// onto AlphaBackground. Frames before 'start' are composited but not
+// converted, and frames after the range aren't decoded.
+func (h *PHasher) readGIFFrames(p string, start, count int) ([]gocv.Mat, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if count >= 0 {
+		data = truncateGIF(data, start+count)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", p, err)
+	}
+	bounds := stdimage.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := stdimage.NewRGBA(bounds)
+	background := stdimage.NewUniform(h.AlphaBackground)
+	if h.AlphaBackground == nil {
+		background = stdimage.NewUniform(stdimage.Black)
+	}
+	var frames []gocv.Mat
+	for i, frame := range g.Image {
+		var previous *stdimage.RGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = stdimage.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if i >= start {
+			m, err := h.gifFrame(canvas, background)
+			if err != nil {
+				for _, m := range frames {
+					m.Close()
+				}
+				return nil, fmt.Errorf("%q frame %d: %v", p, i, err)
+			}
+			frames = append(frames, m)
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), stdimage.Transparent, stdimage.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, nil
+}
+
+// truncateGIF returns the GIF 'data' cut after its first 'frames' images, so
+// image/gif doesn't decode the rest. Data it can't parse is returned as is,
+// for image/gif to report.
+func truncateGIF(data []byte, frames int) []byte {
+	if len(data) < 13 || frames <= 0 {
+		return data
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&7 + 1) // global color table
+	}
+	// skipBlocks returns the offset after the data sub-blocks at 'i'.
+	skipBlocks := func(i int) int {
+		for i < len(data) {
+			n := int(data[i])
+			i += 1 + n
+			if n == 0 {
+				return i
+			}
+		}
+		return len(data) + 1
+	}
+	for n := 0; i < len(data); {
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i = skipBlocks(i + 2)
+		case 0x2c: // image: descriptor, local color table, LZW code size, sub-blocks
+			if i+10 > len(data) {
+				return data
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&7 + 1)
+			}
+			i = skipBlocks(i + 1)
+			if n++; n == frames && i <= len(data) {
+				return append(data[:i:i], 0x3b)
+			}
+		default:
+			return data
+		}
+	}
+	return data
+}
+
+// gifFrame flattens 'canvas' onto 'background' and converts it to a
+// grayscale Mat according to Grayscale.
+func (h *PHasher) gifFrame(canvas *stdimage.RGBA, background stdimage.Image) (gocv.Mat, error) {
+	bounds := canvas.Bounds()
+	if h.Grayscale == GrayLuma {
+		gray := stdimage.NewGray(bounds)
+		draw.Draw(gray, bounds, background, stdimage.Point{}, draw.Src)
+		draw.Draw(gray, bounds, canvas, stdimage.Point{}, draw.Over)
+		return gocv.ImageGrayToMatGray(gray)
+	}
+	flat := stdimage.NewRGBA(bounds)
+	draw.Draw(flat, bounds, background, stdimage.Point{}, draw.Src)
+	draw.Draw(flat, bounds, canvas, stdimage.Point{}, draw.Over)
+	bgr, err := gocv.ImageToMatRGB(flat)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer bgr.Close()
+	return h.toGray(bgr), nil
+}
+
+// walkFrames reads the frames of the container 'name' in directory 'p',
+// passing each to 'fn' as an image numbered from 1 and keyed by the
+// container's name without its extension. A single-page container matching
+// containerFrameRe is keyed and numbered like a JPEG frame of the same name
+// instead. Frames outside StartFrame and EndFrame aren't read, except that
+// the first two pages of a container matching containerFrameRe are read to
+// tell whether it has a single page. It returns false if 'fn' does.
+func (h *PHasher) walkFrames(p, name, fileKey string, stats *runStats, fn func(*image) bool) bool {
+	fullPath := path.Join(p, name)
+	h.debugf("reading frames: %q", fullPath)
+	readStart := time.Now()
+	prefix, first := strings.TrimSuffix(name, path.Ext(name)), 1
+	start, count := h.pageRange(first)
+	var frames []gocv.Mat
+	var err error
+	if matches := containerFrameRe.FindStringSubmatch(name); matches != nil {
+		frames, err = h.readFrames(fullPath, 0, 2)
+		if n, nerr := strconv.Atoi(matches[2]); err == nil && nerr == nil && len(frames) == 1 {
+			prefix, first, start = matches[1], n, 0
+		} else if err == nil {
+			for _, frame := range frames {
+				frame.Close()
+			}
+			frames = nil
+			if count != 0 {
+				frames, err = h.readFrames(fullPath, start, count)
+			}
+		}
+	} else if count != 0 {
+		frames, err = h.readFrames(fullPath, start, count)
+	}
+	for i := range frames {
+		frames[i] = h.reduceMat(frames[i])
+	}
+	stats.read.since(readStart)
+	if err != nil {
+		h.infof("skipping file: %v", err)
+		stats.skip(skipEmpty)
+		return true
+	}
+	entry, ok := h.manifestEntry(p, fullPath)
+	key := entry.Key
+	if !ok {
+		key = h.imageKey(p, prefix, fileKey)
+	}
+	for i, frame := range frames {
+		n := first + start + i
+		if frame.Empty() {
+			h.infof("empty frame %d: %q", n, fullPath)
+			stats.skip(skipEmpty)
+			frame.Close()
+			continue
+		}
+		if !h.inFrameWindow(n) {
+			stats.skip(skipOutsideFrames)
+			frame.Close()
+			continue
+		}
+		if h.checkpoint.has(fullPath, n) {
+			stats.skip(skipCheckpoint)
+			frame.Close()
+			continue
+		}
+		img := &image{path: fullPath, img: frame, frame: n, key: key}
+		img.metadata = h.frameMetadata(entry.Metadata, img)
+		if !fn(img) {
+			for _, rest := range frames[i+1:] {
+				rest.Close()
+			}
+			return false
+		}
+	}
+	return true
+}
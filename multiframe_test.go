@@ -0,0 +1,91 @@
+package phash
+
+import (
+	"bytes"
+	stdimage "image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeGIF writes a GIF of 'frames' copies of test image 'src' to 'file'.
+func writeGIF(t *testing.T, file, src string, frames int) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	img, _, err := stdimage.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paletted := stdimage.NewPaletted(img.Bounds(), palette.Plan9)
+	draw.Draw(paletted, paletted.Rect, img, img.Bounds().Min, draw.Src)
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := gif.EncodeAll(out, anim); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerFrameKeys(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	writeGIF(t, filepath.Join(dir, "clip-0003.gif"), "cat3.jpg", 1)
+	writeGIF(t, filepath.Join(dir, "anim-0001.gif"), "cat4.jpg", 2)
+	h := testDB(t)
+	if summary := h.StoreHashesFromDirs([]string{dir}); summary.Stored != 3 {
+		t.Fatalf("stored %d frames, want 3", summary.Stored)
+	}
+	want := []string{dir + "/anim-0001 1", dir + "/anim-0001 2", dir + "/clip 3"}
+	if got := tableRows(t, h.DBFile, "key_hashes"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %q, want %q", got, want)
+	}
+}
+
+func TestContainerFrameWindow(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "anim.gif")
+	writeGIF(t, file, "cat3.jpg", 5)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for frames := 1; frames <= 5; frames++ {
+		g, err := gif.DecodeAll(bytes.NewReader(truncateGIF(data, frames)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Image) != frames {
+			t.Errorf("truncated to %d frames, got %d", frames, len(g.Image))
+		}
+	}
+
+	h := testDB(t)
+	h.StartFrame, h.EndFrame = 2, 3
+	if summary := h.StoreHashesFromDirs([]string{dir}); summary.Stored != 2 {
+		t.Fatalf("stored %d frames, want 2", summary.Stored)
+	}
+	want := []string{dir + "/anim 2", dir + "/anim 3"}
+	if got := tableRows(t, h.DBFile, "key_hashes"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,56 @@
+package phash
+
+import (
+	"database/sql"
+	"log"
+)
+
+// hashRow is a scanned row of fullpath, frame, and optionally hash words.
+// Rows from partial inserts in old DBs may have NULLs in any column, so
+// they're scanned into nullable types and skipped rather than failing the
+// lookup.
+type hashRow struct {
+	key   sql.NullString
+	frame sql.NullInt64
+	words []sql.NullInt64
+}
+
+// dest returns the scan destinations for a row with 'words' hash columns,
+// or none.
+func (r *hashRow) dest(words int) []interface{} {
+	d := []interface{}{&r.key, &r.frame}
+	r.words = make([]sql.NullInt64, words)
+	for i := range r.words {
+		d = append(d, &r.words[i])
+	}
+	return d
+}
+
+// valid reports whether the scanned columns are all non-NULL.
+func (r *hashRow) valid() bool {
+	if !r.key.Valid || !r.frame.Valid {
+		return false
+	}
+	for _, w := range r.words {
+		if !w.Valid {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the row as a Match, and its hash words in 'stored' if it's
+// not nil.
+func (r *hashRow) match(stored []uint32) Match {
+	for i := range stored {
+		stored[i] = uint32(r.words[i].Int64)
+	}
+	return Match{Key: r.key.String, Frame: int(r.frame.Int64)}
+}
+
+// logNullRows reports rows skipped by a lookup because of NULLs.
+func logNullRows(n int) {
+	if n > 0 {
+		log.Printf("skipped %d stored rows with NULL columns", n)
+	}
+}
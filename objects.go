@@ -0,0 +1,168 @@
+package phash
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ObjectSource lists and fetches encoded images from an object store, e.g.
+// S3 or GCS, so they can be hashed without copying them to local disk.
+// Implementations must be safe for concurrent use.
+type ObjectSource interface {
+	// List calls 'fn' with the name of each object under 'prefix', stopping
+	// if it returns false.
+	List(ctx context.Context, prefix string, fn func(name string) bool) error
+	// Fetch returns the contents of object 'name'.
+	Fetch(ctx context.Context, name string) ([]byte, error)
+}
+
+// objectKey returns the key and frame number of object 'name', derived like
+// those of frame images in directories with '/' separating directories.
+// KeyFile and Manifest aren't used for objects.
+func (h *PHasher) objectKey(name string) (key string, frame int, ok bool) {
+	dir, base := path.Split(name)
+	matches := frameRe.FindStringSubmatch(base)
+	if matches == nil {
+		return "", 0, false
+	}
+	frame, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return "", 0, false
+	}
+	if h.KeyFromDir {
+		return h.normalizeKey(path.Clean(dir)), frame, true
+	}
+	return h.normalizeKey(path.Join(dir, matches[1])), frame, true
+}
+
+// readObjects lists the objects under 'prefixes' in 'src', fetching and
+// decoding up to FetchProcs of them at once, and sends them to 'c'.
+// Deterministic runs fetch one object at a time, in listing order.
+func (h *PHasher) readObjects(ctx context.Context, src ObjectSource, prefixes []string, c chan *image, stats *runStats) {
+	procs := h.FetchProcs
+	if procs <= 0 || h.Deterministic {
+		procs = 1
+	}
+	names := make(chan string)
+	var seq int64
+	var seqMu sync.Mutex
+	wg := &sync.WaitGroup{}
+	for i := 0; i < procs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				img := h.fetchObject(ctx, src, name, stats)
+				if img == nil {
+					continue
+				}
+				seqMu.Lock()
+				img.seq = seq
+				seq++
+				c <- img
+				seqMu.Unlock()
+			}
+		}()
+	}
+	stop := h.stopped()
+	for _, prefix := range prefixes {
+		err := src.List(ctx, prefix, func(name string) bool {
+			atomic.AddInt64(&stats.files, 1)
+			select {
+			case names <- name:
+				return true
+			case <-stop:
+				return false
+			}
+		})
+		if err != nil {
+			log.Printf("listing %q: %v", prefix, err)
+		}
+	}
+	close(names)
+	wg.Wait()
+}
+
+// fetchObject fetches and decodes object 'name', returning nil if it's
+// skipped.
+func (h *PHasher) fetchObject(ctx context.Context, src ObjectSource, name string, stats *runStats) *image {
+	key, frame, ok := h.objectKey(name)
+	if !ok {
+		stats.skip(skipNotFrame)
+		return nil
+	}
+	if !h.inFrameWindow(frame) {
+		stats.skip(skipOutsideFrames)
+		return nil
+	}
+	if h.checkpoint.has(name, frame) {
+		stats.skip(skipCheckpoint)
+		return nil
+	}
+	h.debugf("fetching object: %q", name)
+	start := time.Now()
+	data, err := src.Fetch(ctx, name)
+	if err != nil {
+		stats.read.since(start)
+		h.infof("skipping object: %q: %v", name, err)
+		stats.skip(skipEmpty)
+		return nil
+	}
+	img := &image{path: name, key: key, frame: frame, img: h.decodeNamed(name, data)}
+	if h.CheckDeterminism {
+		img.encoded = data
+	}
+	if h.StoreContentHashes {
+		sum := sha256.Sum256(data)
+		img.contentHash = sum[:]
+	}
+	stats.read.since(start)
+	if img.img.Empty() {
+		h.infof("empty image: %q", name)
+		stats.skip(skipEmpty)
+		return nil
+	}
+	return img
+}
+
+// objectRun hashes the objects under 'prefixes' in ObjectSource in mode 'm'.
+func (h *PHasher) objectRun(ctx context.Context, prefixes []string, m mode) Summary {
+	if h.ObjectSource == nil {
+		log.Print("ObjectSource not set")
+		return Summary{}
+	}
+	return h.withStore(m, func(st Store) Summary {
+		return h.runSource(func(c chan *image, stats *runStats) {
+			h.readObjects(ctx, h.ObjectSource, prefixes, c, stats)
+		}, h.modeSink(m, st))
+	})
+}
+
+// StoreHashesFromObjects stores hashes of the images under 'prefixes' in
+// ObjectSource like StoreHashesFromDirs, including its guard against
+// storing into a non-empty DB.
+func (h *PHasher) StoreHashesFromObjects(ctx context.Context, prefixes []string) Summary {
+	if err := h.checkStoreAllowed(); err != nil {
+		log.Print(err)
+		return Summary{}
+	}
+	unlock, err := h.lockStore()
+	if err != nil {
+		log.Print(err)
+		return Summary{}
+	}
+	defer unlock()
+	return h.objectRun(ctx, prefixes, store)
+}
+
+// LookupObjects looks up the images under 'prefixes' in ObjectSource like
+// LookupHashesInDirs.
+func (h *PHasher) LookupObjects(ctx context.Context, prefixes []string) Summary {
+	return h.objectRun(ctx, prefixes, query)
+}
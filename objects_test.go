@@ -0,0 +1,58 @@
+package phash
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mapObjects is an ObjectSource holding objects in memory.
+type mapObjects map[string][]byte
+
+func (m mapObjects) List(ctx context.Context, prefix string, fn func(name string) bool) error {
+	var names []string
+	for name := range m {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !fn(name) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m mapObjects) Fetch(ctx context.Context, name string) ([]byte, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func TestStoreHashesFromObjectsCheckDeterminism(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	objects := make(mapObjects)
+	for i, name := range []string{"cat3.jpg", "cat4.jpg"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[fmt.Sprintf("bucket/video-%04d.jpg", i+1)] = data
+	}
+	h := testDB(t)
+	h.ObjectSource = objects
+	h.CheckDeterminism = true
+	summary := h.StoreHashesFromObjects(context.Background(), []string{"bucket/"})
+	if summary.Stored != 2 || summary.Nondeterministic != 0 {
+		t.Errorf("stored %d objects with %d nondeterministic, want 2 and 0", summary.Stored, summary.Nondeterministic)
+	}
+}
@@ -0,0 +1,156 @@
+package phash
+
+import (
+	"context"
+	"fmt"
+	stdimage "image"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Option configures a PHasher opened with OpenHasher.
+type Option func(*PHasher)
+
+// WithMaxDistance sets MaxDistance.
+func WithMaxDistance(d int) Option { return func(h *PHasher) { h.MaxDistance = d } }
+
+// WithQueryTimeout sets QueryTimeout.
+func WithQueryTimeout(d time.Duration) Option { return func(h *PHasher) { h.QueryTimeout = d } }
+
+// WithLookupDBs sets LookupDBs.
+func WithLookupDBs(files ...string) Option { return func(h *PHasher) { h.LookupDBs = files } }
+
+// WithCropRect sets CropRect, which must match the DB's.
+func WithCropRect(r stdimage.Rectangle) Option { return func(h *PHasher) { h.CropRect = r } }
+
+// WithGrayscale sets Grayscale, which must match the DB's.
+func WithGrayscale(m GrayscaleMode) Option { return func(h *PHasher) { h.Grayscale = m } }
+
+// WithReduce sets Reduce, which must match the DB's.
+func WithReduce(factor int) Option { return func(h *PHasher) { h.Reduce = factor } }
+
+// OpenHasher opens the existing DB 'dbFile' for querying, checking that
+// hashing is supported, that the DB has been initialized, and that its
+// recorded hash settings match the options. The DB stays open until Close,
+// so LookupByHash and LookupFiles can be called repeatedly without reopening
+// it. Methods that operate on a whole DB, e.g. KeyCounts, still open DBFile
+// themselves.
+func OpenHasher(dbFile string, opts ...Option) (*PHasher, error) {
+	h := &PHasher{DBFile: dbFile, DBTimeout: 30 * time.Second}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if err := CheckHashSupport(); err != nil {
+		return nil, err
+	}
+	h.warnHashLen()
+	if err := h.checkReduce(); err != nil {
+		return nil, err
+	}
+	if h.Store == nil && h.DBTemplate == "" {
+		// Opening a missing file would create an empty DB.
+		if _, err := os.Stat(dbFile); err != nil {
+			return nil, err
+		}
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.validateStore(st); err != nil {
+		release()
+		return nil, err
+	}
+	h.store = st
+	h.closeStore = release
+	return h, nil
+}
+
+// validateStore checks that 'st' is reachable and initialized, and that its
+// hash settings match PHasher's.
+func (h *PHasher) validateStore(st Store) error {
+	if p, ok := st.(pinger); ok {
+		if err := p.Ping(context.Background()); err != nil {
+			return err
+		}
+	}
+	if s, ok := st.(*SQLiteStore); ok {
+		var n int
+		table := s.tableQuery(defaultTable)
+		if err := s.db.QueryRow(tableExistsQuery, table).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("DB %q has no %q table; run InitDB first", h.DBFile, table)
+		}
+	}
+	return h.checkSettings(st, false)
+}
+
+// Close releases the store opened by OpenHasher. It does nothing for other
+// PHashers.
+func (h *PHasher) Close() error {
+	if h.closeStore != nil {
+		h.closeStore()
+	}
+	h.store, h.closeStore = nil, nil
+	return nil
+}
+
+// LookupByHash returns the stored frames within MaxDistance of 'hash',
+// retrying while the DB is locked and honoring QueryTimeout. It's safe to
+// call from many goroutines on a PHasher opened with OpenHasher; lookup
+// statements are prepared once and shared.
+func (h *PHasher) LookupByHash(ctx context.Context, hash []byte) ([]Match, error) {
+	st, release, err := h.openStore()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if h.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.QueryTimeout)
+		defer cancel()
+	}
+	var matches []Match
+	_, err = retry(func() error {
+		var err error
+		matches, err = st.Lookup(ctx, hash, h.MaxDistance)
+		return err
+	}, h.DBTimeout)
+	return matches, err
+}
+
+// LookupFiles hashes and looks up each image file in 'paths', in order, in
+// the calling goroutine. Files that can't be read or hashed have Err set in
+// their result.
+func (h *PHasher) LookupFiles(paths ...string) []QueryResult {
+	st, release, err := h.openStore()
+	if err != nil {
+		results := make([]QueryResult, len(paths))
+		for i, p := range paths {
+			results[i] = QueryResult{Path: p, Err: err}
+		}
+		return results
+	}
+	defer release()
+	stats := newRunStats()
+	results := make([]QueryResult, 0, len(paths))
+	for _, p := range paths {
+		atomic.AddInt64(&stats.files, 1)
+		img := &image{path: p, img: h.readImage(p)}
+		if img.img.Empty() {
+			img.img.Close()
+			results = append(results, QueryResult{Path: p, Err: fmt.Errorf("%q: %v", p, ErrEmptyImage)})
+			continue
+		}
+		img.key, img.frame = h.importKey(p)
+		if !h.processImage(img, stats) {
+			results = append(results, QueryResult{Path: p, Err: fmt.Errorf("%q: could not be hashed", p)})
+			continue
+		}
+		results = append(results, h.lookupImage(st, img, stats))
+	}
+	return results
+}
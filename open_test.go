@@ -0,0 +1,79 @@
+package phash
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testHash returns a distinct hash for frame 'frame', as long as the hashes
+// OpenCV computes.
+func testHash(frame int) []byte {
+	var hash []byte
+	for i := 0; len(hash) < runtimeHashLen(); i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprint(frame, i)))
+		hash = append(hash, sum[:]...)
+	}
+	return hash[:runtimeHashLen()]
+}
+
+func TestLookupByHashConcurrent(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	const frames = 100
+	dbFile := filepath.Join(t.TempDir(), "phash.db")
+	setup := &PHasher{DBFile: dbFile}
+	if err := setup.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	st, release, err := setup.openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []Result
+	for i := 1; i <= frames; i++ {
+		results = append(results, Result{Key: "video", Frame: i, Hash: testHash(i)})
+	}
+	_, err = st.Insert(results)
+	release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxDist := range []int{0, 8} {
+		t.Run(fmt.Sprintf("maxdist=%d", maxDist), func(t *testing.T) {
+			h, err := OpenHasher(dbFile, WithMaxDistance(maxDist))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			const goroutines, lookups = 32, 50
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < lookups; i++ {
+						frame := (g*lookups+i)%frames + 1
+						matches, err := h.LookupByHash(context.Background(), testHash(frame))
+						if err != nil {
+							t.Errorf("frame %d: %v", frame, err)
+							return
+						}
+						if len(matches) != 1 || matches[0].Key != "video" || matches[0].Frame != frame {
+							t.Errorf("frame %d: got matches %+v", frame, matches)
+							return
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// fileLimitErr returns 'err' with advice added if it's because the process
+// or system ran out of file descriptors, which is easy to hit with macOS's
+// default limit.
+func fileLimitErr(err error) error {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return fmt.Errorf("%w; raise the open file limit (e.g. ulimit -n 4096) or lower ReadProcs", err)
+	}
+	return err
+}
+
+// readProcs returns the number of paths read at once.
+func (h *PHasher) readProcs() int {
+	if h.ReadProcs > 0 {
+		return h.ReadProcs
+	}
+	return runtime.NumCPU()
+}
@@ -0,0 +1,47 @@
+package phash
+
+import "sync"
+
+// getImagesInOrder reads images from each of 'paths' in turn into 'c',
+// numbering them in read order for reorder.
+func (h *PHasher) getImagesInOrder(paths []string, c chan *image, wg *sync.WaitGroup, stats *runStats) {
+	defer wg.Done()
+	stop := h.stopped()
+	var seq int64
+	for _, p := range paths {
+		h.walkImages(p, stats, func(img *image) bool {
+			img.seq = seq
+			select {
+			case c <- img:
+				seq++
+				return true
+			case <-stop:
+				img.img.Close()
+				return false
+			}
+		})
+	}
+}
+
+// reorder passes images from 'in' to 'out' in the order they were read by
+// getImagesInOrder, dropping images that couldn't be hashed, and closes
+// 'out' once 'in' is closed.
+func reorder(in, out chan *image) {
+	defer close(out)
+	pending := make(map[int64]*image)
+	var next int64
+	for img := range in {
+		pending[img.seq] = img
+		for {
+			img, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if img.hash != nil {
+				out <- img
+			}
+		}
+	}
+}
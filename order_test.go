@@ -0,0 +1,91 @@
+package phash
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// writeFrames writes 'n' frame images of one video to 'dir', alternating
+// between the test images.
+func writeFrames(t *testing.T, dir string, n int) {
+	t.Helper()
+	images := []string{"cat3.jpg", "cat4.jpg"}
+	for i := 0; i < n; i++ {
+		data, err := os.ReadFile(images[i%len(images)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("video-%04d.jpg", i+1)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// hashRows returns the rows of 'key_hashes' in 'dbFile', in storage order.
+func hashRows(t *testing.T, dbFile string) []string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select fullpath, frame, h1, h2, h3, h4 from key_hashes order by rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var key string
+		var frame int
+		var words [4]int64
+		if err := rows.Scan(&key, &frame, &words[0], &words[1], &words[2], &words[3]); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, fmt.Sprintf("%s %d %v", key, frame, words))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDeterministicStoreIndependentOfProcs(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	const frames = 40
+	dir := t.TempDir()
+	writeFrames(t, dir, frames)
+
+	var stored [][]string
+	for _, procs := range []int{1, 8} {
+		dbFile := filepath.Join(t.TempDir(), "phash.db")
+		h := &PHasher{
+			DBFile:        dbFile,
+			DBTimeout:     30 * time.Second,
+			HashProcs:     procs,
+			BatchSize:     7,
+			Deterministic: true,
+			Quiet:         true,
+		}
+		if err := h.InitDB(); err != nil {
+			t.Fatal(err)
+		}
+		summary := h.StoreHashesFromDirs([]string{dir})
+		if summary.Stored != frames {
+			t.Fatalf("%d procs: stored %d frames, want %d", procs, summary.Stored, frames)
+		}
+		stored = append(stored, hashRows(t, dbFile))
+	}
+	if !reflect.DeepEqual(stored[0], stored[1]) {
+		t.Errorf("rows stored with 8 procs differ from 1 proc:\n%v\nvs\n%v", stored[1], stored[0])
+	}
+}
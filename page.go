@@ -0,0 +1,175 @@
+package phash
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+)
+
+// pagedStore is implemented by Stores that can return a page of a lookup's
+// matches without materializing them all.
+type pagedStore interface {
+	LookupPage(ctx context.Context, hash []byte, maxDist, limit, offset int) ([]Match, int, error)
+}
+
+// matchLess orders matches by distance, then key and frame, so pages are
+// stable across calls.
+func matchLess(a, b Match) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Frame < b.Frame
+}
+
+// pageHeap holds the first matches seen in matchLess order, with the last of
+// them at the root.
+type pageHeap []Match
+
+func (p pageHeap) Len() int            { return len(p) }
+func (p pageHeap) Less(i, j int) bool  { return matchLess(p[j], p[i]) }
+func (p pageHeap) Swap(i, j int)       { p[i], p[j] = p[j], p[i] }
+func (p *pageHeap) Push(x interface{}) { *p = append(*p, x.(Match)) }
+func (p *pageHeap) Pop() interface{} {
+	old := *p
+	x := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return x
+}
+
+// add keeps 'm' if it's among the first 'n' matches; n <= 0 keeps all.
+func (p *pageHeap) add(m Match, n int) {
+	if n <= 0 || len(*p) < n {
+		heap.Push(p, m)
+	} else if matchLess(m, (*p)[0]) {
+		(*p)[0] = m
+		heap.Fix(p, 0)
+	}
+}
+
+// pageMatches returns at most 'limit' of 'matches' after skipping 'offset',
+// in matchLess order. limit <= 0 returns all remaining matches.
+func pageMatches(matches []Match, limit, offset int) []Match {
+	sort.Slice(matches, func(i, j int) bool { return matchLess(matches[i], matches[j]) })
+	if offset >= len(matches) {
+		return nil
+	}
+	matches = matches[offset:]
+	if limit > 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+const countHashesQuery = "select count(*) from key_hashes where h1 = ? and h2 = ? and h3 = ? and h4 = ? and fullpath is not null and frame is not null"
+
+// LookupPage returns at most 'limit' of the stored frames matching 'hash',
+// after skipping 'offset', in matchLess order, along with the total number of
+// matches. Frames matching through several variants count once, at their
+// closest distance. Exact lookups page in SQL; fuzzy lookups without
+// variants keep only offset+limit matches while scanning.
+func (s *SQLiteStore) LookupPage(ctx context.Context, hash []byte, maxDist, limit, offset int) ([]Match, int, error) {
+	if err := checkHashLen(hash); err != nil {
+		return nil, 0, err
+	}
+	if maxDist <= 0 && !s.Variants {
+		un := s.unpack(hash)
+		stmt, err := s.stmt(ctx, s.tableQuery(countHashesQuery))
+		if err != nil {
+			return nil, 0, err
+		}
+		var total int
+		if err := stmt.QueryRowContext(ctx, wordArgs(un)...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+		if limit <= 0 {
+			limit = -1 // no limit
+		}
+		matches, err := s.queryMatches(ctx, lookupHashesQuery+" order by fullpath, frame limit ? offset ?", wordArgs(un, limit, offset)...)
+		if err != nil {
+			return nil, 0, err
+		}
+		return matches, total, s.addMetadata(ctx, matches)
+	}
+	if maxDist <= 0 {
+		// Lookup merges frames repeated by variants before paging.
+		matches, err := s.Lookup(ctx, hash, maxDist)
+		if err != nil {
+			return nil, 0, err
+		}
+		return pageMatches(matches, limit, offset), len(matches), nil
+	}
+	n := 0
+	if limit > 0 {
+		n = offset + limit
+	}
+	total := 0
+	var best pageHeap
+	if !s.Variants {
+		err := s.scanWithin(ctx, hash, maxDist, func(m Match) {
+			total++
+			best.add(m, n)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		matches := pageMatches(best, limit, offset)
+		return matches, total, s.addMetadata(ctx, matches)
+	}
+	// Variants may repeat frames, so keep each frame's closest match before
+	// counting and paging.
+	closest := make(map[frameID]Match)
+	err := s.scanWithin(ctx, hash, maxDist, func(m Match) {
+		id := frameID{m.Key, m.Frame}
+		if c, ok := closest[id]; !ok || m.Distance < c.Distance {
+			closest[id] = m
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, m := range closest {
+		total++
+		best.add(m, n)
+	}
+	matches := pageMatches(best, limit, offset)
+	return matches, total, s.addMetadata(ctx, matches)
+}
+
+// lookupPage pages a lookup of 'hash' in 'st', in SQL if 'st' supports it.
+func (h *PHasher) lookupPage(ctx context.Context, st Store, hash []byte) ([]Match, int, error) {
+	if ps, ok := st.(pagedStore); ok {
+		return ps.LookupPage(ctx, hash, h.MaxDistance, h.Limit, h.Offset)
+	}
+	matches, err := st.Lookup(ctx, hash, h.MaxDistance)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pageMatches(matches, h.Limit, h.Offset), len(matches), nil
+}
+
+// LookupPage is LookupByHash returning only the matches selected by Limit
+// and Offset, in order of distance, key, and frame, along with the total
+// number of matches.
+func (h *PHasher) LookupPage(ctx context.Context, hash []byte) ([]Match, int, error) {
+	st, release, err := h.openStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+	if h.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.QueryTimeout)
+		defer cancel()
+	}
+	var matches []Match
+	var total int
+	_, err = retry(func() error {
+		var err error
+		matches, total, err = h.lookupPage(ctx, st, hash)
+		return err
+	}, h.DBTimeout)
+	return matches, total, err
+}
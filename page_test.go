@@ -0,0 +1,81 @@
+package phash
+
+import (
+	"context"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestLookupPageCountsVariantFramesOnce(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := testDB(t,
+		Result{Key: "a", Frame: 1, Hash: testHash(1), Variants: []Variant{{Name: "flip", Hash: flipBit(testHash(1), 0)}}},
+		Result{Key: "b", Frame: 1, Hash: flipBit(testHash(1), 1)},
+	)
+	db, err := h.openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := NewSQLiteStore(db)
+	s.Variants = true
+	defer s.closeStmts()
+
+	matches, total, err := s.LookupPage(context.Background(), testHash(1), 4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("got total %d, want 2", total)
+	}
+	if len(matches) != 1 || matches[0].Key != "a" || matches[0].Distance != 0 {
+		t.Errorf("got first page %+v, want frame a 1 at distance 0", matches)
+	}
+	matches, _, err = s.LookupPage(context.Background(), testHash(1), 4, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Key != "b" {
+		t.Errorf("got second page %+v, want frame b 1", matches)
+	}
+}
+
+func TestSQLiteLookupMergesVariants(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	hash := testHash(1)
+	h := testDB(t, Result{Key: "a", Frame: 1, Hash: hash, Variants: []Variant{
+		{Name: "flip", Hash: hash},
+		{Name: "rot180", Hash: flipBit(hash, 1)},
+	}})
+	db, err := h.openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := NewSQLiteStore(db)
+	s.Variants = true
+	defer s.closeStmts()
+	as, err := NewAttachedStore([]string{h.DBFile}, h.openDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as.Variants = true
+	defer as.Close()
+
+	for _, st := range []Store{s, as} {
+		for _, maxDist := range []int{0, 4} {
+			matches, err := st.Lookup(context.Background(), hash, maxDist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != 1 || matches[0].Distance != 0 {
+				t.Errorf("%T within %d: got matches %+v, want frame a 1 once at distance 0", st, maxDist, matches)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package phash
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LookupPaths looks up the image files named by newline-delimited paths read
+// from 'r', e.g. stdin, printing each result as soon as its lookup finishes
+// like LookupHashesInDirs. Blank lines are ignored. Paths are read as they
+// arrive, so results stream while 'r' is still being written.
+func (h *PHasher) LookupPaths(r io.Reader) Summary {
+	if err := CheckHashSupport(); err != nil {
+		log.Fatal(err)
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer release()
+	if err := h.checkSettings(st, false); err != nil {
+		log.Fatal(err)
+	}
+	return h.runSource(func(c chan *image, stats *runStats) {
+		h.readPathList(r, c, stats)
+	}, func(dbC chan *image, wg *sync.WaitGroup, stats *runStats) {
+		h.lookupHashes(dbC, st, wg, stats, h.printQueryResult)
+	})
+}
+
+// trimPaths returns 'paths' with leading and trailing whitespace removed,
+// e.g. left by tools generating path lists, warning about each path changed.
+// Paths that exist as given are kept; blank paths are dropped.
+func (h *PHasher) trimPaths(paths []string) []string {
+	result := make([]string, 0, len(paths))
+	for _, p := range paths {
+		trimmed := strings.TrimSpace(p)
+		if trimmed == p {
+			result = append(result, p)
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			result = append(result, p)
+			continue
+		}
+		if trimmed == "" {
+			h.infof("warning: ignoring blank path %q", p)
+			continue
+		}
+		h.infof("warning: trimmed whitespace from path %q", p)
+		result = append(result, trimmed)
+	}
+	return result
+}
+
+// readPathList reads the image files named by lines of 'r' into 'c'. Keys
+// and frames are derived from each path as for ImportHashes.
+func (h *PHasher) readPathList(r io.Reader, c chan *image, stats *runStats) {
+	stop := h.stopped()
+	scanner := bufio.NewScanner(r)
+	var seq int64
+	for scanner.Scan() {
+		p := strings.TrimSpace(scanner.Text())
+		if p == "" {
+			continue
+		}
+		atomic.AddInt64(&stats.files, 1)
+		h.debugf("reading file: %q", p)
+		start := time.Now()
+		img := &image{path: p, img: h.readImage(p), seq: seq}
+		stats.read.since(start)
+		if img.img.Empty() {
+			h.infof("empty image: %q", p)
+			stats.skip(skipEmpty)
+			continue
+		}
+		img.key, img.frame = h.importKey(p)
+		select {
+		case c <- img:
+			seq++
+		case <-stop:
+			img.img.Close()
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,77 @@
+//go:build pdf
+// +build pdf
+
+package phash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gocv.io/x/gocv"
+)
+
+// pdfSupported reports whether PDFs are hashed page by page. It requires the
+// "pdf" build tag and poppler's pdftoppm at run time.
+const pdfSupported = true
+
+// pdfRenderer renders PDF pages to images.
+const pdfRenderer = "pdftoppm"
+
+// pdfResolution is the resolution in DPI pages are rendered at. Hashes are
+// computed on downscaled images, so higher resolutions only cost time.
+const pdfResolution = 72
+
+// pdfPageRe matches the page images written by pdftoppm, e.g. "page-07.png".
+var pdfPageRe = regexp.MustCompile(`^page-([0-9]+)[.]png$`)
+
+// readPDFPages renders pages of the PDF at 'p' with pdftoppm, as in
+// readFrames, and reads them as grayscale, in page order. Pages outside the
+// range aren't rendered. The caller must close the results.
+func (h *PHasher) readPDFPages(p string, start, count int) ([]gocv.Mat, error) {
+	dir, err := ioutil.TempDir("", "phash-pdf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	args := []string{"-r", strconv.Itoa(pdfResolution), "-png", "-f", strconv.Itoa(start + 1)}
+	if count >= 0 {
+		args = append(args, "-l", strconv.Itoa(start+count))
+	}
+	cmd := exec.Command(pdfRenderer, append(args, p, filepath.Join(dir, "page"))...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%q: %s: %v: %s", p, pdfRenderer, err, out)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[int]string)
+	var numbers []int
+	for _, f := range files {
+		matches := pdfPageRe.FindStringSubmatch(f.Name())
+		if matches == nil {
+			continue
+		}
+		n, err := strconv.Atoi(matches[1])
+		if err != nil {
+			continue
+		}
+		pages[n] = filepath.Join(dir, f.Name())
+		numbers = append(numbers, n)
+	}
+	if len(numbers) == 0 {
+		return nil, fmt.Errorf("%q: %v", p, ErrEmptyImage)
+	}
+	sort.Ints(numbers)
+	frames := make([]gocv.Mat, 0, len(numbers))
+	for _, n := range numbers {
+		frames = append(frames, h.readImage(pages[n]))
+	}
+	return frames, nil
+}
@@ -0,0 +1,18 @@
+//go:build !pdf
+// +build !pdf
+
+package phash
+
+import (
+	"errors"
+
+	"gocv.io/x/gocv"
+)
+
+// pdfSupported reports whether PDFs are hashed page by page. Without the
+// "pdf" build tag they're skipped like other non-frame files.
+const pdfSupported = false
+
+func (h *PHasher) readPDFPages(p string, start, count int) ([]gocv.Mat, error) {
+	return nil, errors.New("built without PDF support")
+}
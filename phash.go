@@ -4,32 +4,349 @@ package phash
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	stdimage "image"
+	"image/color"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gocv.io/x/gocv"
-	cv_contrib "gocv.io/x/gocv/contrib"
 )
 
 type PHasher struct {
-	DBFile    string
+	DBFile string
+	// Table is the name of the hash table, 'key_hashes' if empty, so several
+	// independent indexes can share a DB file. Its variants are stored in
+	// Table+"_variants". Thumbnails, content hashes, metadata, and settings
+	// are shared by all tables in a DB, so indexes sharing a file must use
+	// distinct keys and the same hash settings.
+	Table string
+	// DBTemplate, if set, stores each key in its own SQLite DB instead of
+	// DBFile, named by substituting the key for "{key}", e.g.
+	// "db/{key}.sqlite" (see ShardedStore). Queries search every shard,
+	// QueryProcs at a time, or only those of keys starting with KeyPrefix.
+	// Methods that operate on a whole DB, e.g. KeyCounts, still use DBFile.
+	DBTemplate string
+	QueryProcs int
+	KeyPrefix  string
+	// LookupDBs are additional DB files searched by queries along with
+	// DBFile, by attaching them to a connection (see AttachedStore). Stores
+	// still only write to DBFile.
+	LookupDBs []string
 	DBTimeout time.Duration
 	KeyFile   string // key filename for directories of images
 	HashProcs int
+	// ReadProcs bounds the number of paths read at once, each holding open
+	// a directory and an image file. If it's not positive,
+	// runtime.NumCPU() is used.
+	ReadProcs int
+	// ObjectSource is read by StoreHashesFromObjects and LookupObjects, with
+	// up to FetchProcs objects fetched at once (1 if not positive).
+	ObjectSource ObjectSource
+	FetchProcs   int
+	// Manifest is a file mapping directories or filename patterns to keys
+	// (see ManifestEntry). Images matching an entry use its key; others fall
+	// back to KeyFile, KeyFromDir, or the filename.
+	Manifest string
+	// FoldKeys lower-cases and NFC-normalizes keys before storing or looking
+	// them up, so filenames differing only in case or Unicode normalization
+	// (e.g. NFD names from macOS) get the same key. Stores into an existing
+	// DB and lookups by key, e.g. Thumbnail, must use the setting the DB was
+	// built with.
+	FoldKeys bool
+	// Recursive also reads images in subdirectories of each path, except
+	// those matching ExcludeDirs. Each subdirectory is handled like a path
+	// argument, e.g. with its own KeyFile.
+	Recursive bool
+	// ExcludeDirs are path.Match patterns for directories skipped, along
+	// with everything below them, by Recursive walks, e.g. ".git" or
+	// "thumbs". Patterns are matched against each directory's name and its
+	// full path.
+	ExcludeDirs []string
+	// KeyFromDir uses the directory containing each image as its key, so the
+	// filename only contributes the frame number. KeyFile takes precedence.
+	KeyFromDir bool
+	// Synchronous sets SQLite's synchronous pragma: "OFF", "NORMAL", or
+	// "FULL". Empty uses SQLite's default (FULL). OFF is much faster for bulk
+	// loads but an OS crash or power loss mid-run can corrupt the DB; only use
+	// it for DBs that can be rebuilt by re-running the store.
+	Synchronous string
+	// PageSize sets SQLite's page size in bytes when InitDB creates a new
+	// DB. It has no effect on an existing DB; InitDB warns if it differs.
+	PageSize int
+	// Clustered creates 'key_hashes' in a new DB as a WITHOUT ROWID table
+	// keyed on (fullpath, frame), so each key's frames are stored together
+	// in frame order, which speeds up scans of consecutive frames such as
+	// MatchSequence. Like PageSize, it has no effect on an existing DB.
+	Clustered bool
+	// CacheSize sets SQLite's cache_size pragma on every connection:
+	// positive values are pages, negative values are KiB.
+	CacheSize int
+	// QueryTimeout cancels individual lookups that take longer than this.
+	// Timed out lookups are reported as errors in the query output. Zero
+	// means no timeout.
+	QueryTimeout time.Duration
+	// BatchSize is the number of frames stored per DB transaction. Defaults
+	// to 100.
+	BatchSize int
+	// FlushInterval, if positive, also commits a partial batch once this
+	// long has passed since the last time-based commit, so slow inputs
+	// persist progress regularly.
+	FlushInterval time.Duration
+	// WALCheckpointCommits and WALCheckpointInterval, if positive,
+	// checkpoint and truncate the DB's write-ahead log after that many
+	// commits or that long, whichever comes first, so the -wal file of a
+	// long store run stays bounded. They have no effect unless the DB is in
+	// WAL mode.
+	WALCheckpointCommits  int
+	WALCheckpointInterval time.Duration
+	// KeyStreams batches each key's frames separately in store mode, so
+	// every batch holds frames of a single key and a key's frames commit
+	// together rather than interleaved with other keys'. This improves
+	// locality and makes Checkpoint progress per key, at the cost of more,
+	// smaller transactions when many keys are stored at once.
+	KeyStreams bool
+	// CommitRate, if positive, limits store runs to this many batch commits
+	// per second, e.g. to avoid overwhelming shared network storage. Frames
+	// are read and hashed no faster than they can be committed.
+	CommitRate float64
+	// AlphaBackground is the color transparent PNG regions are flattened
+	// onto before hashing. Defaults to black.
+	AlphaBackground color.Color
+	// Orientations additionally hashes horizontally flipped and 180 degree
+	// rotated copies of each frame, so mirrored or rotated copies still
+	// match. Variant hashes are stored in the 'key_hash_variants' table,
+	// tripling the number of stored hashes, and are searched by lookups.
+	Orientations bool
+	// Tiles, if greater than 1, additionally hashes a Tiles x Tiles grid of
+	// overlapping tiles of each frame, so cropped or letterboxed copies
+	// still match some tile. Tile hashes are stored in the
+	// 'key_hash_variants' table, multiplying the number of stored hashes by
+	// up to Tiles*Tiles+1 (10x for a 3x3 grid); query runs must also set
+	// Tiles to search them.
+	Tiles int
+	// Scales additionally hashes copies of each frame resized by these
+	// factors, e.g. 0.5, so downscaled copies still match. Scaled hashes are
+	// stored in the 'key_hash_variants' table, tagged with their scale, and
+	// queries look up the input at each scale as well, keeping the closest
+	// match for each stored frame. A scale of 1 is the frame hash itself.
+	Scales []float64
+	// Anamorphic, if positive and not 1, additionally hashes each frame with
+	// its width stretched by this pixel aspect ratio (e.g. 32/27 for
+	// anamorphic NTSC DVDs), so squeezed and display-corrected copies match
+	// each other. The corrected hash is stored in the 'key_hash_variants'
+	// table, and queries look up the input's corrected hash as well.
+	Anamorphic float64
+	// Since skips files last modified before this time, for incremental
+	// scans. SinceGrace is subtracted from it to tolerate clock skew on
+	// network mounts; it defaults to defaultSinceGrace.
+	Since      time.Time
+	SinceGrace time.Duration
+	// StartFrame and EndFrame, if positive, skip frames numbered below or
+	// above them, e.g. to leave out intro credits. Videos aren't decoded
+	// directly, so the window is in frame numbers rather than times; for
+	// frames extracted at a known rate, multiply times by the rate. Frame
+	// image files outside the window aren't read at all, but multi-frame
+	// containers are still decoded in full, and frames outside the window
+	// are dropped after decoding.
+	StartFrame int
+	EndFrame   int
+	// SceneThreshold, if positive, only stores a frame if its hash differs
+	// from the last stored hash for the same key by at least this Hamming
+	// distance, keeping one representative frame per scene. Frames are
+	// compared in the order they're hashed, which only matches frame order
+	// with HashProcs set to 1 or Deterministic set.
+	SceneThreshold int
+	// Deterministic makes multi-process runs handle images in the same
+	// order as a single-process run: paths are read one at a time, hashed
+	// images are put back in read order before being stored or printed, and
+	// store batches are committed one at a time. The stored rows, including
+	// their order, then don't depend on HashProcs, at the cost of some
+	// throughput and of buffering images hashed out of order.
+	Deterministic bool
+	// CheckDeterminism hashes each image twice, reading image files again,
+	// and drops images whose hashes differ with a warning, so flaky decoding
+	// or hardware can't put inconsistent hashes in the DB. It roughly
+	// doubles the cost of reading and hashing; dropped images are counted in
+	// Summary.Nondeterministic.
+	CheckDeterminism bool
+	// SlowestImages, if positive, times hashing each frame and lists this
+	// many of the slowest in Summary.Slowest, e.g. to find huge frames that
+	// dominate a run and are worth downscaling.
+	SlowestImages int
+	// Conflict selects what stores do with frames already stored with a
+	// different hash: keep the stored hash (the default), replace it, or
+	// fail the batch so the change can be audited.
+	Conflict ConflictPolicy
+	// Checkpoint, if set, is a file recording each frame committed by a
+	// store, appended to after every batch. A restarted store skips the
+	// frames it lists without reading them, so interrupted ingests resume
+	// where they stopped. Delete it to start over.
+	Checkpoint string
+	// Force allows storing into a non-empty DB without Since.
+	Force bool
+	// LockWait is how long a store waits for another process storing into
+	// the same DBFile to finish, detected with an advisory lock on
+	// DBFile+".lock". Zero fails immediately; negative waits indefinitely.
+	LockWait time.Duration
+	// CropRect, if not empty, restricts hashing to this region of each
+	// image, e.g. to exclude overlays at the edges. It is clipped to the
+	// image; images it doesn't overlap are skipped. The crop is recorded in
+	// the DB's settings, and store and query runs must use the same crop.
+	CropRect stdimage.Rectangle
+	// Grayscale selects how color images are reduced to grayscale before
+	// hashing. It's recorded in the DB's settings, and store and query runs
+	// must use the same mode.
+	Grayscale GrayscaleMode
+	// Reduce, if 2, 4, or 8, decodes images at 1/Reduce scale using
+	// OpenCV's reduced decode, which is much faster for large images and
+	// barely changes block mean hashes. Images that can't be decoded reduced
+	// are resized instead. CropRect stays in full-scale pixels and is scaled
+	// to match. It's recorded in the DB's settings, and store and query
+	// runs must use the same factor.
+	Reduce int
+	// MinDimension skips images (after cropping and preprocessing) narrower
+	// or shorter than this many pixels, whose hashes are degenerate and
+	// match unexpectedly. Defaults to 8; negative values disable the check.
+	MinDimension int
+	// Preprocess, if set, transforms each decoded grayscale image (after
+	// CropRect) before it's hashed, e.g. to denoise or normalize contrast.
+	// It must not close its argument, and may return it unchanged; any other
+	// Mat it returns is closed by PHasher. Images for which it returns an
+	// error are skipped. It's called concurrently when HashProcs > 1.
+	Preprocess func(gocv.Mat) (gocv.Mat, error)
+	// StoreThumbnails stores a small JPEG preview of each frame in the
+	// 'thumbnails' table. This significantly increases DB size.
+	StoreThumbnails bool
+	// StoreContentHashes stores the SHA-256 of each frame file's bytes in
+	// the 'content_hashes' table, so FindDuplicates can tell byte-identical
+	// frames from perceptually similar ones.
+	StoreContentHashes bool
+	// ExpectedFrames maps keys to the number of frames they should have.
+	// After a store, keys whose stored count deviates by more than
+	// FrameTolerance (a fraction of the expected count) are reported.
+	ExpectedFrames map[string]int
+	FrameTolerance float64
+	// Store is the backend for store and query modes. If nil, a SQLiteStore
+	// on DBFile is used.
+	Store Store
+	// MaxDistance is the maximum Hamming distance for matches in query mode.
+	// Zero only finds exact matches.
+	MaxDistance int
+	// Limit, if positive, returns at most this many matches per lookup, in
+	// order of distance, key, and frame.
+	Limit int
+	// Offset skips this many matches per lookup before applying Limit.
+	Offset int
+	// DistanceMetric selects how distances are computed for fuzzy lookups
+	// in SQLite DBs. MemStore always uses Hamming distance.
+	DistanceMetric DistanceMetric
+	// HashFormat controls how hashes are printed in show and query modes.
+	HashFormat HashFormat
+	// OutputFormat controls the layout of query output.
+	OutputFormat OutputFormat
+	// OnlyNew prints whether each query image is NEW (no stored frame
+	// within MaxDistance) or a DUPLICATE instead of listing its matches.
+	OnlyNew bool
+	// LogLevel controls logging verbosity. Per-file progress is only logged
+	// at LogDebug.
+	LogLevel LogLevel
+	// Quiet only logs errors, regardless of LogLevel.
+	Quiet bool
+	// Metrics receives pipeline events, e.g. for benchmarking.
+	Metrics Metrics
+	// Metadata, if set, returns name/value pairs to store with each frame,
+	// e.g. a source URL or ingest batch ID, in the 'frame_metadata' table.
+	// They override metadata from Manifest entries, and are returned with
+	// matches. It's called concurrently when there are multiple paths.
+	Metadata func(path, key string, frame int) map[string]string
+
+	manifest   []ManifestEntry
+	checkpoint *checkpoint
+	// store is held open between calls by OpenHasher.
+	store      Store
+	closeStore func()
+
+	stopMu sync.Mutex
+	stopC  chan struct{}
+}
+
+// stopped returns a channel that is closed when Stop is called.
+func (h *PHasher) stopped() chan struct{} {
+	h.stopMu.Lock()
+	defer h.stopMu.Unlock()
+	if h.stopC == nil {
+		h.stopC = make(chan struct{})
+	}
+	return h.stopC
+}
+
+// Stop stops reading new images. Images already read are still hashed and,
+// in store mode, committed before the running pipeline returns, so an
+// interrupted store leaves the DB consistent up to the point of
+// interruption. Stop is safe to call from any goroutine, including signal
+// handlers, and more than once. A stopped PHasher reads no further images.
+func (h *PHasher) Stop() {
+	c := h.stopped()
+	h.stopMu.Lock()
+	defer h.stopMu.Unlock()
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// defaultSinceGrace is the clock skew tolerated for Since if SinceGrace is
+// unset.
+const defaultSinceGrace = 2 * time.Second
+
+// since returns the modification time before which files are skipped, or
+// the zero time if Since is unset.
+func (h *PHasher) since() time.Time {
+	if h.Since.IsZero() {
+		return h.Since
+	}
+	grace := h.SinceGrace
+	if grace == 0 {
+		grace = defaultSinceGrace
+	}
+	return h.Since.Add(-grace)
+}
+
+// defaultBatchSize is the number of frames per commit if BatchSize is unset.
+const defaultBatchSize = 100
+
+func (h *PHasher) batchSize() int {
+	if h.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+	return h.BatchSize
 }
 
+// createTableQuery creates the 'key_hashes' table used by InitDB.
+const createTableQuery = "CREATE TABLE IF NOT EXISTS key_hashes(fullpath text, mtime text, frame integer, h1 bigint, h2 bigint, h3 bigint, h4 bigint, UNIQUE(fullpath, frame))"
+
+// createClusteredTableQuery creates 'key_hashes' clustered by (fullpath,
+// frame) for Clustered.
+const createClusteredTableQuery = "CREATE TABLE IF NOT EXISTS key_hashes(fullpath text, mtime text, frame integer, h1 bigint, h2 bigint, h3 bigint, h4 bigint, PRIMARY KEY(fullpath, frame)) WITHOUT ROWID"
+
 // insertHashesQuery is used to insert hashes into the 'key_hashes' table.
-// CREATE TABLE key_hashes(fullpath text, mtime text, frame integer, h1 bigint, h2 bigint, h3 bigint, h4 bigint);
 const insertHashesQuery = "INSERT INTO key_hashes(fullpath, frame, h1, h2, h3, h4) values(?,?,?,?,?,?)"
 const lookupHashesQuery = "select fullpath, frame from key_hashes where h1 = ? and h2 = ? and h3 = ? and h4 = ?"
 
@@ -38,269 +355,819 @@ type image struct {
 	path  string
 	img   gocv.Mat
 	frame int
-	hash  gocv.Mat
-	// image filename with "-[0-9]+.jpg" removed
+	hash  []byte
+	// image filename with "-[0-9]+.(jpg|png)" removed
 	key string
+	// JPEG preview, if StoreThumbnails is set
+	thumb []byte
+	// hashes of transformed copies of the image
+	variants []Variant
+	// SHA-256 of the file, if StoreContentHashes is set
+	contentHash []byte
+	// encoded image, kept for CheckDeterminism if it wasn't read from a
+	// local file
+	encoded []byte
+	// metadata to store with the frame
+	metadata map[string]string
+	// read order, if Deterministic is set
+	seq int64
+}
+
+// result returns the Result to store for a hashed image.
+func (img *image) result() Result {
+	return Result{
+		Key:         img.key,
+		Frame:       img.frame,
+		Path:        img.path,
+		Hash:        img.hash,
+		Variants:    img.variants,
+		Thumbnail:   img.thumb,
+		ContentHash: img.contentHash,
+		Metadata:    img.metadata,
+	}
 }
 
+// frameRe matches frame image filenames, capturing the key prefix and the
+// frame number.
+var frameRe = regexp.MustCompile("(.*)-([0-9]+)[.](jpg|png)")
+
 // getImages gets all images from a path into a stream
-// TODO: make this recursive
 // TODO: switch to directory walking in parallel ala https://www.oreilly.com/learning/run-strikingly-fast-parallel-file-searches-in-go-with-sync-errgroup
-// TODO: pass flag value as argument
-func (h *PHasher) getImages(p string, c chan *image, wg *sync.WaitGroup) {
+func (h *PHasher) getImages(p string, c chan *image, wg *sync.WaitGroup, stats *runStats) {
 	defer wg.Done()
-	files, err := ioutil.ReadDir(p)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-	if len(files) == 0 {
-		log.Printf("no files in %q", p)
-		return
-	}
+	stop := h.stopped()
+	h.walkImages(p, stats, func(img *image) bool {
+		select {
+		case c <- img:
+			return true
+		case <-stop:
+			img.img.Close()
+			return false
+		}
+	})
+}
+
+// walkImages reads the frame images in directory 'p', and its subdirectories
+// if Recursive is set, passing each to 'fn' until it returns false or Stop is
+// called, in which case it returns false. Animated GIFs and multi-page TIFFs
+// contribute one image per frame.
+// TODO: pass flag value as argument
+func (h *PHasher) walkImages(p string, stats *runStats, fn func(*image) bool) bool {
+	// Keys and paths are stored with forward slashes on every OS, so DBs
+	// are portable.
+	p = filepath.ToSlash(p)
 	var fileKey string
 	if h.KeyFile != "" {
 		fullKeyFile := path.Join(p, h.KeyFile)
-		log.Printf("reading key from %q", fullKeyFile)
+		h.debugf("reading key from %q", fullKeyFile)
 		b, err := ioutil.ReadFile(fullKeyFile)
 		if err != nil {
-			log.Print(err)
-			return
+			log.Print(fileLimitErr(err))
+			return true
 		}
-		fileKey = string(b)
+		fileKey = filepath.ToSlash(string(b))
 		if fileKey == "" {
 			log.Print("expected nonempty key")
-			return
+			return true
 		}
 	}
 	// TODO: get a hash of the file header, add to struct
-	re := regexp.MustCompile("(.*)-([0-9]+)[.]jpg")
-	for _, f := range files {
+	stop := h.stopped()
+	since := h.since()
+	// modifiedBefore reports whether 'f' was last modified before Since.
+	modifiedBefore := func(f os.DirEntry) bool {
+		if since.IsZero() {
+			return false
+		}
+		info, err := f.Info()
+		return err == nil && info.ModTime().Before(since)
+	}
+	more := true
+	n, err := h.readDir(p, func(f os.DirEntry) bool {
+		select {
+		case <-stop:
+			more = false
+			return false
+		default:
+		}
+		if f.IsDir() && h.Recursive {
+			sub := path.Join(p, f.Name())
+			if h.excludedDir(sub) {
+				h.debugf("skipping excluded directory: %q", sub)
+				stats.skip(skipExcludedDir)
+				return true
+			}
+			more = h.walkImages(sub, stats, fn)
+			return more
+		}
+		atomic.AddInt64(&stats.files, 1)
+		if isMultiFrame(f.Name()) {
+			if modifiedBefore(f) {
+				stats.skip(skipOld)
+				return true
+			}
+			more = h.walkFrames(p, f.Name(), fileKey, stats, fn)
+			return more
+		}
 		fullPath := path.Join(p, f.Name())
-		matches := re.FindStringSubmatch(f.Name())
+		matches := frameRe.FindStringSubmatch(f.Name())
 		// TODO: support video files directly with goav
 		// TODO: support tar files of images
 		if matches == nil {
-			// log.Printf("skipping file: %q; regex: %v", fullPath, re)
-			continue
+			// log.Printf("skipping file: %q; regex: %v", fullPath, frameRe)
+			stats.skip(skipNotFrame)
+			return true
 		}
 		frame, err := strconv.Atoi(matches[2])
 		if err != nil {
-			log.Printf("skipping file: %q; failed to parse frame: %v", fullPath, matches)
-			continue
+			h.infof("skipping file: %q; failed to parse frame: %v", fullPath, matches)
+			stats.skip(skipBadFrame)
+			return true
+		}
+		if !h.inFrameWindow(frame) {
+			stats.skip(skipOutsideFrames)
+			return true
+		}
+		if modifiedBefore(f) {
+			stats.skip(skipOld)
+			return true
+		}
+		if h.checkpoint.has(fullPath, frame) {
+			stats.skip(skipCheckpoint)
+			return true
 		}
-		log.Printf("reading file: %q", fullPath)
+		h.debugf("reading file: %q", fullPath)
 		img := &image{
 			path:  fullPath,
-			img:   gocv.IMRead(fullPath, gocv.IMReadGrayScale),
 			frame: frame,
 		}
-		if h.KeyFile != "" {
-			img.key = fileKey
+		start := time.Now()
+		if h.StoreContentHashes {
+			img.img, img.contentHash = h.readImageContent(fullPath)
+		} else {
+			img.img = h.readImage(fullPath)
+		}
+		stats.read.since(start)
+		entry, ok := h.manifestEntry(p, fullPath)
+		if ok {
+			img.key = entry.Key
 		} else {
-			img.key = path.Join(p, matches[1])
+			img.key = h.imageKey(p, matches[1], fileKey)
 		}
+		img.metadata = h.frameMetadata(entry.Metadata, img)
 		if img.img.Empty() {
-			log.Print(fmt.Sprintf("empty image: %q", fullPath))
-			continue
+			h.infof("empty image: %q", fullPath)
+			stats.skip(skipEmpty)
+			return true
 		}
-		c <- img
+		more = fn(img)
+		return more
+	})
+	if err != nil {
+		log.Print(fileLimitErr(err))
+		return more
+	}
+	if n == 0 {
+		h.infof("no files in %q", p)
+	}
+	return more
+}
+
+// inFrameWindow reports whether 'frame' is within StartFrame and EndFrame.
+func (h *PHasher) inFrameWindow(frame int) bool {
+	return (h.StartFrame <= 0 || frame >= h.StartFrame) && (h.EndFrame <= 0 || frame <= h.EndFrame)
+}
+
+// excludedDir reports whether directory 'dir' matches one of ExcludeDirs,
+// either by name or by full path.
+func (h *PHasher) excludedDir(dir string) bool {
+	name := path.Base(dir)
+	for _, pattern := range h.ExcludeDirs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readDirBatch is the number of directory entries read at a time.
+const readDirBatch = 1024
+
+// readDir calls 'fn' with each entry of directory 'p' until it returns
+// false, returning the number of entries passed to 'fn'. Entries are read in
+// batches in directory order, so huge directories are never held in memory
+// at once and hashing starts right away. Deterministic runs read and sort
+// the whole directory instead, so the order doesn't depend on the file
+// system.
+func (h *PHasher) readDir(p string, fn func(os.DirEntry) bool) (int, error) {
+	if h.Deterministic {
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return 0, err
+		}
+		for i, e := range entries {
+			if !fn(e) {
+				return i + 1, nil
+			}
+		}
+		return len(entries), nil
+	}
+	d, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+	n := 0
+	for {
+		entries, err := d.ReadDir(readDirBatch)
+		for _, e := range entries {
+			n++
+			if !fn(e) {
+				return n, nil
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// imageKey returns the key for a frame image in directory 'dir' whose
+// filename prefix (before the frame number) is 'prefix'. 'fileKey' is the
+// contents of KeyFile, if set.
+func (h *PHasher) imageKey(dir, prefix, fileKey string) string {
+	switch {
+	case h.KeyFile != "":
+		return h.normalizeKey(fileKey)
+	case h.KeyFromDir:
+		return h.normalizeKey(path.Clean(dir))
+	default:
+		return h.normalizeKey(path.Join(dir, prefix))
 	}
 }
 
 // processImages reads images from 'c', adds perceptual hashes, and writes the
 // results to 'dbC'.
-func processImages(c chan *image, wg *sync.WaitGroup, dbC chan *image) {
+func (h *PHasher) processImages(c chan *image, wg *sync.WaitGroup, dbC chan *image, stats *runStats) {
 	defer wg.Done()
-	hasher := cv_contrib.BlockMeanHash{}
 	for img := range c {
-		img.hash = gocv.NewMat()
-		hasher.Compute(img.img, &img.hash)
+		// Deterministic runs pass on unhashed images too, so reorder knows
+		// not to wait for them.
+		if h.processImage(img, stats) || h.Deterministic {
+			dbC <- img
+		}
+	}
+}
+
+// processImage adds perceptual hashes to 'img' and releases its pixels. It
+// returns false if the image can't be hashed.
+func (h *PHasher) processImage(img *image, stats *runStats) bool {
+	defer stats.hash.since(time.Now())
+	prepared, err := h.prepareImage(img.img)
+	defer prepared.Close()
+	if err != nil {
+		h.infof("skipping file: %q: %v", img.path, err)
+		switch {
+		case err == ErrCropOutside:
+			stats.skip(skipCrop)
+		case err == ErrTooSmall:
+			stats.skip(skipSmall)
+		default:
+			stats.skip(skipPreprocess)
+		}
 		img.img.Close()
-		// block mean hash: 1x32 bytes
-		// log.Printf("%q hash: %v", img.path, img.hash.ToBytes())
-		dbC <- img
+		return false
+	}
+	hashStart := time.Now()
+	img.hash = h.hashMat(prepared)
+	if h.SlowestImages > 0 {
+		stats.recordTiming(ImageTiming{
+			Path:   img.path,
+			Frame:  img.frame,
+			Width:  prepared.Cols(),
+			Height: prepared.Rows(),
+			Hash:   time.Since(hashStart),
+		}, h.SlowestImages)
 	}
+	atomic.AddInt64(&stats.hashed, 1)
+	if h.CheckDeterminism && !h.hashesRepeat(img, prepared, stats) {
+		// Deterministic runs forward every image; reorder drops those
+		// without a hash.
+		img.hash = nil
+		img.img.Close()
+		return false
+	}
+	if h.Orientations {
+		img.variants = append(img.variants, h.orientationVariants(prepared)...)
+	}
+	if h.Tiles > 1 {
+		img.variants = append(img.variants, h.tileVariants(prepared)...)
+	}
+	if len(h.Scales) > 0 {
+		img.variants = append(img.variants, h.scaleVariants(prepared)...)
+	}
+	img.variants = append(img.variants, h.anamorphicVariant(prepared)...)
+	if h.StoreThumbnails {
+		thumb, err := makeThumbnail(img.img)
+		if err != nil {
+			log.Printf("failed to make thumbnail for %q: %v", img.path, err)
+		}
+		img.thumb = thumb
+	}
+	img.img.Close()
+	// block mean hash: 1x32 bytes
+	// log.Printf("%q hash: %v", img.path, img.hash)
+	return true
 }
 
-// unpackHash converts a 32-byte hash from byte slice to a uint32 array
+// unpackHash converts the stored words of a hash (see hashWords) from byte
+// slice to a uint32 array
 func unpackHash(h []byte) []uint32 {
-	result := make([]uint32, 4)
+	return unpackWords(h, hashWords(len(h)))
+}
+
+// unpackWords converts the first 'n' words of a hash from byte slice to a
+// uint32 array, padding short hashes with zeros.
+func unpackWords(h []byte, n int) []uint32 {
+	result := make([]uint32, n)
 	buf := bytes.NewBuffer(h)
-	for i := 0; i < 4; i++ {
+	for i := range result {
 		binary.Read(buf, binary.BigEndian, &result[i])
 	}
 	return result
 }
 
-// storeHashes reads images over 'dbC' and stores their hashes to 'db'.
-func (h *PHasher) storeHashes(dbC chan *image, db *sql.DB, wg *sync.WaitGroup) {
-	defer wg.Done()
-	commitFrames := func(imgs []*image) error {
-		defer wg.Done()
-		tx, err := db.Begin()
-		defer tx.Rollback()
-		if err != nil {
-			log.Print(err)
-			return err
+// ErrLocked is returned when the DB stays locked for longer than DBTimeout.
+var ErrLocked = errors.New("database is locked")
+
+// isLocked reports whether 'err' means the DB is locked.
+func isLocked(err error) bool {
+	return err == ErrLocked || (err != nil && strings.Contains(err.Error(), "database is locked"))
+}
+
+// maxRetryDelay caps the delay between retries.
+const maxRetryDelay = time.Second
+
+// retry calls 'f' until it succeeds, fails with an error other than a locked
+// DB, or 'timeout' elapses, doubling the delay between attempts from 1ms up
+// to maxRetryDelay. It returns the number of retries, and ErrLocked if the
+// DB was still locked at the timeout.
+func retry(f func() error, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	delay := time.Millisecond
+	retries := 0
+	for {
+		err := f()
+		if !isLocked(err) {
+			return retries, err
 		}
-		stmt, err := tx.Prepare(insertHashesQuery)
-		if err != nil {
-			log.Print(err)
-			return err
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return retries, ErrLocked
 		}
-		for _, img := range imgs {
-			if img == nil {
-				return nil
-			}
-			// TODO: put this inner loop code in a function
-			un := unpackHash(img.hash.ToBytes())
-			img.hash.Close()
-			log.Print(img.key, " ", img.frame)
-			_, err = stmt.Exec(img.key, img.frame, un[0], un[1], un[2], un[3])
-			if err != nil && !strings.Contains(err.Error(), "UNIQUE constraint failed") {
-				log.Print(err)
-				return err
-			}
+		if delay > remaining {
+			delay = remaining
 		}
-		err = tx.Commit()
-		if err != nil {
-			log.Print(err)
-			return err
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
 		}
-		return nil
+		retries++
 	}
+}
 
-	retry := func(f func() error, timeout time.Duration) error {
-		start := time.Now()
-		var err error = nil
-		for ok := true; ok; ok = time.Now().Before(start.Add(timeout)) {
-			err = f()
-			if err == nil ||
-				!strings.Contains(err.Error(), "database is locked") {
-				return err
-			}
-		}
+// commitBatch stores a batch of hashed images in 'st', retrying while the DB
+// is locked.
+func (h *PHasher) commitBatch(st Store, imgs []*image, stats *runStats) {
+	results := make([]Result, len(imgs))
+	for i, img := range imgs {
+		h.debugf("%v %v", img.key, img.frame)
+		results[i] = img.result()
+	}
+	if !h.insertResults(st, results, stats) {
+		return
+	}
+	if err := h.checkpoint.record(imgs); err != nil {
+		log.Printf("checkpoint: %v", err)
+	}
+}
+
+// insertResults stores a batch of results in 'st', retrying while the DB is
+// locked. It returns false if the batch couldn't be stored.
+func (h *PHasher) insertResults(st Store, results []Result, stats *runStats) bool {
+	start := time.Now()
+	stored := 0
+	retries, err := retry(func() error {
+		var err error
+		stored, err = st.Insert(results)
 		return err
+	}, h.DBTimeout)
+	h.Metrics.commit(len(results), time.Since(start), retries, err)
+	stats.store.since(start)
+	atomic.AddInt64(&stats.retries, int64(retries))
+	if err != nil {
+		log.Print(err)
+		atomic.AddInt64(&stats.failed, 1)
+		return false
 	}
+	atomic.AddInt64(&stats.commits, 1)
+	atomic.AddInt64(&stats.stored, int64(stored))
+	atomic.AddInt64(&stats.existing, int64(len(results)-stored))
+	h.checkpointWAL(st, stats)
+	return true
+}
 
-	count := 0
-	batch := 100
-	imgs := make([]*image, 0, batch)
-	for img := range dbC {
-		imgs = append(imgs, img)
-		if count%batch == 0 {
-			log.Print("commit")
-			wg.Add(1)
-			imgsCopy := make([]*image, len(imgs))
-			copy(imgsCopy, imgs)
-			go retry(func() error { return commitFrames(imgsCopy) }, h.DBTimeout)
-			imgs = make([]*image, 0, batch)
-		}
-		count++
-	}
-	wg.Add(1)
-	go retry(func() error { return commitFrames(imgs) }, h.DBTimeout)
+// sceneChanged reports whether 'img' should be stored under SceneThreshold,
+// given the last stored hash for each key in 'last', which it updates.
+func (h *PHasher) sceneChanged(last *lastHashes, img *image, stats *runStats) bool {
+	if h.SceneThreshold <= 0 {
+		return true
+	}
+	changed := last.update(img.key, img.hash, func(prev []byte, ok bool) bool {
+		return !ok || HammingDistance(prev, img.hash) >= h.SceneThreshold
+	})
+	if !changed {
+		stats.skip(skipScene)
+	}
+	return changed
+}
+
+// storeHashes reads images over 'dbC' and stores their hashes in 'st'.
+func (h *PHasher) storeHashes(dbC chan *image, st Store, wg *sync.WaitGroup, stats *runStats) {
+	defer wg.Done()
+	commit := func(imgs []*image) {
+		defer wg.Done()
+		h.commitBatch(st, imgs, stats)
+	}
+
+	batch := h.batchSize()
+	// pending holds the batch being filled for each commit stream: one per
+	// key with KeyStreams, and a single one otherwise.
+	pending := make(map[string][]*image)
+	limiter := newRateLimiter(h.CommitRate)
+	flushBatch := func(stream string) {
+		h.debugf("commit")
+		limiter.wait()
+		wg.Add(1)
+		if h.Deterministic {
+			commit(pending[stream])
+		} else {
+			go commit(pending[stream])
+		}
+		delete(pending, stream)
+	}
+	flushAll := func() {
+		streams := make([]string, 0, len(pending))
+		for stream := range pending {
+			streams = append(streams, stream)
+		}
+		sort.Strings(streams)
+		for _, stream := range streams {
+			flushBatch(stream)
+		}
+	}
+	var flush <-chan time.Time
+	if h.FlushInterval > 0 {
+		ticker := time.NewTicker(h.FlushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	lastHashes := newLastHashes()
+loop:
+	for {
+		select {
+		case img, ok := <-dbC:
+			if !ok {
+				break loop
+			}
+			if !h.sceneChanged(lastHashes, img, stats) {
+				continue
+			}
+			var stream string
+			if h.KeyStreams {
+				stream = img.key
+			}
+			pending[stream] = append(pending[stream], img)
+			if len(pending[stream]) == batch {
+				flushBatch(stream)
+			}
+		case <-flush:
+			flushAll()
+		}
+	}
+	flushAll()
 	// log.Print("done storing")
 }
 
 // printHashes prints hashes from images in 'dbC'.
-func printHashes(dbC chan *image, wg *sync.WaitGroup) {
+func (h *PHasher) printHashes(dbC chan *image, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for img := range dbC {
-		un := unpackHash(img.hash.ToBytes())
-		fmt.Printf("%v\t%v\n", img.path, un)
+		fmt.Println(h.showLine(img.path, img.hash))
 	}
 }
 
-// lookupHashes looks up hashes from images in 'dbC' in 'db' and prints the results.
-func lookupHashes(dbC chan *image, db *sql.DB, wg *sync.WaitGroup) {
+// lookupHashes looks up hashes from images in 'dbC' in 'st' and passes the
+// results to 'emit' as each lookup finishes. 'emit' may be called
+// concurrently.
+func (h *PHasher) lookupHashes(dbC chan *image, st Store, wg *sync.WaitGroup, stats *runStats, emit func(QueryResult)) {
 	defer wg.Done()
 
-	stmt, err := db.Prepare(lookupHashesQuery)
-	if err != nil {
-		log.Print(err)
-		return
+	for img := range dbC {
+		wg.Add(1)
+		go func(img *image) {
+			defer wg.Done()
+			emit(h.lookupImage(st, img, stats))
+		}(img)
 	}
-	lookupHash := func(img *image) {
-		defer wg.Done()
-		un := unpackHash(img.hash.ToBytes())
-		rows, err := stmt.Query(un[0], un[1], un[2], un[3])
-		if err != nil {
-			log.Print(err)
-			return
+}
+
+// lookupImage looks up the hash of a single image in 'st'.
+func (h *PHasher) lookupImage(st Store, img *image, stats *runStats) QueryResult {
+	ctx := context.Background()
+	if h.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.QueryTimeout)
+		defer cancel()
+	}
+	paged := h.Limit > 0 || h.Offset > 0
+	scaled := false
+	for _, v := range img.variants {
+		scaled = scaled || isLookupVariant(v)
+	}
+	var matches []Match
+	total := -1
+	retries, err := retry(func() error {
+		var err error
+		if paged && !scaled {
+			matches, total, err = h.lookupPage(ctx, st, img.hash)
+			return err
 		}
-		defer rows.Close()
-		paths := make([]string, 0)
-		frames := make([]int, 0)
-		for rows.Next() {
-			var filepath string
-			var frame int
-			if err := rows.Scan(&filepath, &frame); err != nil {
-				log.Fatal(err)
+		matches, err = st.Lookup(ctx, img.hash, h.MaxDistance)
+		for _, v := range img.variants {
+			if err != nil || !isLookupVariant(v) {
+				continue
 			}
-			paths = append(paths, filepath)
-			frames = append(frames, frame)
+			var more []Match
+			more, err = st.Lookup(ctx, v.Hash, h.MaxDistance)
+			matches = mergeMatches(matches, more)
 		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+		return err
+	}, h.DBTimeout)
+	atomic.AddInt64(&stats.retries, int64(retries))
+	if err != nil {
+		log.Printf("lookup of %q: %v", img.path, err)
+		return QueryResult{Path: img.path, Hash: img.hash, Err: err}
+	}
+	if total < 0 {
+		total = len(matches)
+		if paged {
+			matches = pageMatches(matches, h.Limit, h.Offset)
 		}
-		fmt.Printf("%v:%v:%v:%v\n", img.path, un, paths, frames)
 	}
-
-	for img := range dbC {
-		wg.Add(1)
-		go lookupHash(img)
+	if paged {
+		h.infof("%v: %d of %d matches", img.path, len(matches), total)
 	}
+	for i := range matches {
+		matches[i].Query = img.path
+	}
+	atomic.AddInt64(&stats.queried, 1)
+	atomic.AddInt64(&stats.matches, int64(len(matches)))
+	return QueryResult{Path: img.path, Hash: img.hash, Matches: matches, Total: total}
 }
 
 type mode int
 
 const (
-	query mode = 0
-	store mode = 1
-	show  mode = 2
+	query    mode = 0
+	store    mode = 1
+	show     mode = 2
+	storeNew mode = 3
 )
 
-func (h *PHasher) LookupHashesInDirs(paths []string)  { h.pipeline(paths, query) }
-func (h *PHasher) StoreHashesFromDirs(paths []string) { h.pipeline(paths, store) }
-func (h *PHasher) PrintHashesInDirs(paths []string)   { h.pipeline(paths, show) }
+func (h *PHasher) LookupHashesInDirs(paths []string) Summary { return h.pipeline(paths, query) }
+func (h *PHasher) PrintHashesInDirs(paths []string) Summary  { return h.pipeline(paths, show) }
 
-func (h *PHasher) pipeline(paths []string, m mode) {
-	db, err := sql.Open("sqlite3", h.DBFile)
+// StoreHashesFromDirs stores hashes of images in 'paths'. If ExpectedFrames
+// is set, stored frame counts are validated afterwards and discrepancies are
+// logged. Storing into a non-empty DB without Since or Force is refused, to
+// guard against accidentally re-hashing a whole corpus.
+func (h *PHasher) StoreHashesFromDirs(paths []string) Summary {
+	if err := h.checkStoreAllowed(); err != nil {
+		log.Print(err)
+		return Summary{}
+	}
+	unlock, err := h.lockStore()
 	if err != nil {
+		log.Print(err)
+		return Summary{}
+	}
+	defer unlock()
+	if h.Tiles > 1 {
+		h.infof("warning: storing %d tile hashes per frame in addition to the frame hash", h.Tiles*h.Tiles)
+	}
+	summary := h.pipeline(paths, store)
+	if len(h.ExpectedFrames) > 0 {
+		h.logFrameDiscrepancies()
+	}
+	return summary
+}
+
+// InitDB initializes Store, by default creating the hash tables in DBFile if
+// they don't already exist.
+func (h *PHasher) InitDB() error {
+	st, release, err := h.openStore()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return st.Init()
+}
+
+// pipeline reads, hashes, and stores, looks up, or prints images in 'paths',
+// logging and returning a summary of the run.
+func (h *PHasher) pipeline(paths []string, m mode) Summary {
+	paths = h.trimPaths(paths)
+	return h.withStore(m, func(st Store) Summary {
+		if len(paths) == 1 && h.HashProcs == 1 {
+			return h.runInline(paths[0], m, st)
+		}
+		return h.runPipeline(paths, h.modeSink(m, st))
+	})
+}
+
+// withStore opens the store for a run in mode 'm', checks its settings and
+// opens Checkpoint if storing, and returns the result of 'run' on it.
+func (h *PHasher) withStore(m mode, run func(st Store) Summary) Summary {
+	if err := CheckHashSupport(); err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	h.warnHashLen()
+	if err := h.checkReduce(); err != nil {
+		log.Fatal(err)
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer release()
+	if m != show {
+		if err := h.checkSettings(st, m == store || m == storeNew); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if m == store || m == storeNew {
+		cp, err := h.openCheckpoint()
+		if err != nil {
+			log.Fatal(err)
+		}
+		h.checkpoint = cp
+		defer func() {
+			cp.close()
+			h.checkpoint = nil
+		}()
+	}
+	return run(st)
+}
 
+// modeSink returns the sink handling hashed images in mode 'm' with 'st'.
+func (h *PHasher) modeSink(m mode, st Store) sinkFunc {
+	return func(dbC chan *image, wg *sync.WaitGroup, stats *runStats) {
+		switch m {
+		case query:
+			h.lookupHashes(dbC, st, wg, stats, h.printQueryResult)
+		case store:
+			h.storeHashes(dbC, st, wg, stats)
+		case storeNew:
+			h.storeNewHashes(dbC, st, wg, stats)
+		case show:
+			h.printHashes(dbC, wg)
+		}
+	}
+}
+
+// runInline reads, hashes, and handles images from a single directory in the
+// calling goroutine, without the channel pipeline. This avoids goroutine
+// overhead for small jobs and is easier to debug.
+func (h *PHasher) runInline(p string, m mode, st Store) Summary {
+	if err := h.loadManifest(); err != nil {
+		log.Fatal(err)
+	}
+	stats := newRunStats()
+	var imgs []*image
+	lastHashes := newLastHashes()
+	lastFlush := time.Now()
+	limiter := newRateLimiter(h.CommitRate)
+	seen := NewMatcher(st)
+	h.walkImages(p, stats, func(img *image) bool {
+		if !h.processImage(img, stats) {
+			return true
+		}
+		switch m {
+		case query:
+			h.printQueryResult(h.lookupImage(st, img, stats))
+		case store, storeNew:
+			if m == storeNew && !h.isNew(seen, img, stats) {
+				break
+			}
+			if !h.sceneChanged(lastHashes, img, stats) {
+				break
+			}
+			if h.KeyStreams && len(imgs) > 0 && imgs[0].key != img.key {
+				limiter.wait()
+				h.commitBatch(st, imgs, stats)
+				imgs = nil
+			}
+			imgs = append(imgs, img)
+			if len(imgs) == h.batchSize() ||
+				(h.FlushInterval > 0 && time.Since(lastFlush) >= h.FlushInterval) {
+				limiter.wait()
+				h.commitBatch(st, imgs, stats)
+				imgs = nil
+				lastFlush = time.Now()
+			}
+		case show:
+			fmt.Println(h.showLine(img.path, img.hash))
+		}
+		return true
+	})
+	if len(imgs) > 0 {
+		limiter.wait()
+		h.commitBatch(st, imgs, stats)
+	}
+
+	summary := stats.summary()
+	h.infof("summary: %v", summary)
+	return summary
+}
+
+// sinkFunc consumes hashed images from 'dbC', calling wg.Done when finished.
+type sinkFunc func(dbC chan *image, wg *sync.WaitGroup, stats *runStats)
+
+// runPipeline reads and hashes images in 'paths', passing them to 'sink'. It
+// logs and returns a summary of the run.
+func (h *PHasher) runPipeline(paths []string, sink sinkFunc) Summary {
+	return h.runSource(func(c chan *image, stats *runStats) {
+		rg := &sync.WaitGroup{}
+		if h.Deterministic {
+			rg.Add(1)
+			h.getImagesInOrder(paths, c, rg, stats)
+			return
+		}
+		sem := make(chan struct{}, h.readProcs())
+		for _, p := range paths {
+			rg.Add(1)
+			sem <- struct{}{}
+			go func(p string) {
+				defer func() { <-sem }()
+				h.getImages(p, c, rg, stats)
+			}(p)
+		}
+		rg.Wait()
+	}, sink)
+}
+
+// sourceFunc reads images into 'c', returning when it's done.
+type sourceFunc func(c chan *image, stats *runStats)
+
+// runSource hashes the images read by 'source', passing them to 'sink'. It
+// logs and returns a summary of the run.
+func (h *PHasher) runSource(source sourceFunc, sink sinkFunc) Summary {
+	if err := h.loadManifest(); err != nil {
+		log.Fatal(err)
+	}
+	stats := newRunStats()
 	c := make(chan *image)
 	dbC := make(chan *image)
+	hashedC := dbC
+	if h.Deterministic {
+		hashedC = make(chan *image)
+		go reorder(hashedC, dbC)
+	}
 	pg := &sync.WaitGroup{}
-	rg := &sync.WaitGroup{}
 	dg := &sync.WaitGroup{}
 	if h.HashProcs <= 0 {
 		h.HashProcs = runtime.NumCPU()
 	}
 	for i := 0; i < h.HashProcs; i++ {
 		pg.Add(1)
-		go processImages(c, pg, dbC)
-	}
-	for _, p := range paths {
-		rg.Add(1)
-		go h.getImages(p, c, rg)
+		go h.processImages(c, pg, hashedC, stats)
 	}
 	dg.Add(1)
-	switch m {
-	case query:
-		go lookupHashes(dbC, db, dg)
-	case store:
-		go h.storeHashes(dbC, db, dg)
-	case show:
-		go printHashes(dbC, dg)
-	}
-	rg.Wait()
+	go sink(dbC, dg, stats)
+	source(c, stats)
 	close(c)
 	pg.Wait()
-	close(dbC)
+	close(hashedC)
 	dg.Wait()
+
+	summary := stats.summary()
+	h.infof("summary: %v", summary)
+	return summary
 }
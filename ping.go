@@ -0,0 +1,57 @@
+package phash
+
+import (
+	"context"
+	"os"
+)
+
+// pinger is implemented by Stores that can check their connection.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks that hashing is supported (see CheckHashSupport) and that
+// Store's connection is alive, without touching any tables. It's meant for
+// service health checks. A missing DBFile is an error rather than being
+// created.
+func (h *PHasher) Ping(ctx context.Context) error {
+	if err := CheckHashSupport(); err != nil {
+		return err
+	}
+	if h.store == nil && h.Store == nil && h.DBTemplate == "" {
+		// Opening a missing file would create an empty DB.
+		if _, err := os.Stat(h.DBFile); err != nil {
+			return err
+		}
+	}
+	st, release, err := h.openStore()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if p, ok := st.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Ping checks that the DB connection is alive.
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Ping checks that the attached DBs' connections are alive.
+func (s *AttachedStore) Ping(ctx context.Context) error {
+	for _, g := range s.groups {
+		g.mu.Lock()
+		err := g.conn.PingContext(ctx)
+		g.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Primary != nil {
+		return s.Primary.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package phash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPingMissingDB(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	h := &PHasher{DBFile: filepath.Join(t.TempDir(), "phash.db")}
+	if err := h.Ping(context.Background()); err == nil {
+		t.Error("Ping succeeded on a missing DB")
+	}
+	if _, err := os.Stat(h.DBFile); !os.IsNotExist(err) {
+		t.Errorf("Ping created %s", h.DBFile)
+	}
+	if err := h.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,33 @@
+package phash
+
+import "time"
+
+// rateLimiter spaces out events to at most a given rate: a token bucket
+// holding a single token.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter allowing 'perSecond' events per second,
+// or nil, which never waits, if 'perSecond' isn't positive.
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next event is allowed. It isn't safe for concurrent
+// use.
+func (r *rateLimiter) wait() {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	if r.next.After(now) {
+		time.Sleep(r.next.Sub(now))
+		now = r.next
+	}
+	r.next = now.Add(r.interval)
+}
@@ -0,0 +1,66 @@
+package phash
+
+import (
+	"fmt"
+	stdimage "image"
+
+	"gocv.io/x/gocv"
+)
+
+// checkReduce returns an error if Reduce isn't a factor OpenCV can decode
+// at.
+func (h *PHasher) checkReduce() error {
+	switch h.Reduce {
+	case 0, 1, 2, 4, 8:
+		return nil
+	}
+	return fmt.Errorf("reduce factor %d: must be 1, 2, 4, or 8", h.Reduce)
+}
+
+// readFlag returns the flag for reading an image as grayscale if 'gray' is
+// set, or as color, at 1/Reduce scale.
+func (h *PHasher) readFlag(gray bool) gocv.IMReadFlag {
+	switch {
+	case h.Reduce == 2 && gray:
+		return gocv.IMReadReducedGrayscale2
+	case h.Reduce == 4 && gray:
+		return gocv.IMReadReducedGrayscale4
+	case h.Reduce == 8 && gray:
+		return gocv.IMReadReducedGrayscale8
+	case h.Reduce == 2:
+		return gocv.IMReadReducedColor2
+	case h.Reduce == 4:
+		return gocv.IMReadReducedColor4
+	case h.Reduce == 8:
+		return gocv.IMReadReducedColor8
+	case gray:
+		return gocv.IMReadGrayScale
+	}
+	return gocv.IMReadColor
+}
+
+// cropRect returns CropRect, which is in full-scale pixels, scaled to images
+// decoded at 1/Reduce scale, rounding outwards.
+func (h *PHasher) cropRect() stdimage.Rectangle {
+	r := h.CropRect
+	if h.Reduce <= 1 {
+		return r
+	}
+	return stdimage.Rect(r.Min.X/h.Reduce, r.Min.Y/h.Reduce, (r.Max.X+h.Reduce-1)/h.Reduce, (r.Max.Y+h.Reduce-1)/h.Reduce)
+}
+
+// reduceMat returns 'img', decoded at full scale, resized to 1/Reduce
+// scale like a reduced decode, closing 'img' if it's resized. It's used for
+// images that can't be decoded at reduced scale, e.g. PNGs with alpha and
+// multi-frame files.
+func (h *PHasher) reduceMat(img gocv.Mat) gocv.Mat {
+	if h.Reduce <= 1 || img.Empty() {
+		return img
+	}
+	// Reduced decodes round up.
+	sz := stdimage.Pt((img.Cols()+h.Reduce-1)/h.Reduce, (img.Rows()+h.Reduce-1)/h.Reduce)
+	reduced := gocv.NewMat()
+	gocv.Resize(img, &reduced, sz, 0, 0, gocv.InterpolationArea)
+	img.Close()
+	return reduced
+}
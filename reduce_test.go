@@ -0,0 +1,24 @@
+package phash
+
+import (
+	stdimage "image"
+	"testing"
+)
+
+func TestCropRectReduce(t *testing.T) {
+	crop := stdimage.Rect(10, 21, 101, 200)
+	for _, tt := range []struct {
+		reduce int
+		want   stdimage.Rectangle
+	}{
+		{0, crop},
+		{1, crop},
+		{2, stdimage.Rect(5, 10, 51, 100)},
+		{8, stdimage.Rect(1, 2, 13, 25)},
+	} {
+		h := &PHasher{CropRect: crop, Reduce: tt.reduce}
+		if got := h.cropRect(); got != tt.want {
+			t.Errorf("reduce %d: got %v, want %v", tt.reduce, got, tt.want)
+		}
+	}
+}
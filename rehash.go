@@ -0,0 +1,82 @@
+package phash
+
+import "errors"
+
+// createRehashedQuery creates the 'rehashed_frames' table, which flags frames
+// whose hashes were recomputed from something other than the original image.
+const createRehashedQuery = "CREATE TABLE IF NOT EXISTS rehashed_frames(fullpath text, frame integer, source text, UNIQUE(fullpath, frame))"
+const insertRehashedQuery = "INSERT OR REPLACE INTO rehashed_frames(fullpath, frame, source) values(?,?,?)"
+const scanThumbnailsQuery = "select fullpath, frame, thumbnail from thumbnails"
+const updateHashQuery = "UPDATE key_hashes SET h1 = ?, h2 = ?, h3 = ?, h4 = ? where fullpath = ? and frame = ?"
+
+// RehashThumbnails recomputes the hash of every frame with a stored
+// thumbnail from the thumbnail itself, for when the hash algorithm changes
+// but the original images are gone. It returns the number of frames
+// rehashed.
+//
+// A thumbnail is a small lossy copy of the frame, so its hash is close to,
+// but not the same as, the hash of the original; expect fewer exact matches
+// against rehashed frames. Rehashed frames are recorded in the
+// 'rehashed_frames' table with source "thumbnail". Variant hashes are not
+// recomputed. CropRect isn't supported, since thumbnails are scaled.
+func (h *PHasher) RehashThumbnails() (int, error) {
+	if !h.CropRect.Empty() {
+		return 0, errors.New("can't rehash thumbnails with a crop rectangle")
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	// Hash everything before writing, so the read doesn't hold the DB open
+	// across the update.
+	rows, err := db.Query(scanThumbnailsQuery)
+	if err != nil {
+		return 0, err
+	}
+	var results []Result
+	for rows.Next() {
+		var r Result
+		var thumb []byte
+		if err := rows.Scan(&r.Key, &r.Frame, &thumb); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		r.Hash, err = h.HashBytes(thumb)
+		if err != nil {
+			h.infof("skipping thumbnail of %v frame %v: %v", r.Key, r.Frame, err)
+			continue
+		}
+		results = append(results, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createRehashedQuery); err != nil {
+		return 0, err
+	}
+	st, err := h.hashStore(db)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range results {
+		if _, err := tx.Exec(st.tableQuery(updateHashQuery), wordArgs(st.unpack(r.Hash), r.Key, r.Frame)...); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(insertRehashedQuery, r.Key, r.Frame, "thumbnail"); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(results), nil
+}
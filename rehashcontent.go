@@ -0,0 +1,182 @@
+package phash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RehashByContent recomputes stored hashes from the frame images under
+// 'paths', for when the hash algorithm changes. Frames are grouped by the
+// content hashes stored with StoreContentHashes, and each group is decoded
+// and hashed once, from the first file found whose contents still match,
+// then the hash is written to every frame in the group. It returns the
+// number of frames rehashed. Keys are derived as in StoreHashesFromDirs, and
+// the hash settings must match the DB's.
+//
+// Frames without a stored content hash, and groups with no matching file
+// under 'paths', are left alone. Multi-frame files aren't read. Rehashed
+// frames are recorded in the 'rehashed_frames' table with source "content".
+// Variant hashes are not recomputed.
+func (h *PHasher) RehashByContent(paths ...string) (int, error) {
+	if err := h.loadManifest(); err != nil {
+		return 0, err
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	st, err := h.hashStore(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.checkSettings(st, false); err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(scanContentHashesQuery)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return 0, errors.New("DB has no content hashes; store them with StoreContentHashes")
+	}
+	if err != nil {
+		return 0, err
+	}
+	sums := make(map[FrameRef]string)
+	groups := make(map[string][]FrameRef)
+	for rows.Next() {
+		var f FrameRef
+		var sum string
+		if err := rows.Scan(&f.Key, &f.Frame, &sum); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sums[f] = sum
+		groups[sum] = append(groups[sum], f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Hash everything before writing, so the read doesn't hold the DB open
+	// across the update.
+	hashes := make(map[string][]byte, len(groups))
+	for _, p := range paths {
+		more := h.walkFrameFiles(p, func(fullPath string, f FrameRef) bool {
+			sum, ok := sums[f]
+			if !ok {
+				return true
+			}
+			if _, done := hashes[sum]; done {
+				return true
+			}
+			data, err := ioutil.ReadFile(fullPath)
+			if err != nil {
+				log.Print(fileLimitErr(err))
+				return true
+			}
+			actual := sha256.Sum256(data)
+			if hex.EncodeToString(actual[:]) != sum {
+				h.infof("skipping %q: contents changed since it was stored", fullPath)
+				return true
+			}
+			hash, err := h.HashBytes(data)
+			if err != nil {
+				h.infof("skipping %q: %v", fullPath, err)
+				return true
+			}
+			hashes[sum] = hash
+			return len(hashes) < len(groups)
+		})
+		if !more {
+			break
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createRehashedQuery); err != nil {
+		return 0, err
+	}
+	n := 0
+	for sum, hash := range hashes {
+		un := st.unpack(hash)
+		for _, f := range groups[sum] {
+			if _, err := tx.Exec(st.tableQuery(updateHashQuery), wordArgs(un, f.Key, f.Frame)...); err != nil {
+				return 0, err
+			}
+			if _, err := tx.Exec(insertRehashedQuery, f.Key, f.Frame, "content"); err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	h.infof("hashed %d unique files for %d frames", len(hashes), n)
+	if missing := len(groups) - len(hashes); missing > 0 {
+		h.infof("warning: %d content hashes had no matching file; their frames weren't rehashed", missing)
+	}
+	return n, nil
+}
+
+// walkFrameFiles lists the frame image files in directory 'p' like
+// walkImages, without reading them, passing each path and its frame to 'fn'
+// until it returns false, in which case it returns false.
+func (h *PHasher) walkFrameFiles(p string, fn func(string, FrameRef) bool) bool {
+	p = filepath.ToSlash(p)
+	var fileKey string
+	if h.KeyFile != "" {
+		b, err := ioutil.ReadFile(path.Join(p, h.KeyFile))
+		if err != nil {
+			log.Print(fileLimitErr(err))
+			return true
+		}
+		fileKey = filepath.ToSlash(string(b))
+		if fileKey == "" {
+			log.Print("expected nonempty key")
+			return true
+		}
+	}
+	more := true
+	_, err := h.readDir(p, func(f os.DirEntry) bool {
+		fullPath := path.Join(p, f.Name())
+		if f.IsDir() {
+			if h.Recursive && !h.excludedDir(fullPath) {
+				more = h.walkFrameFiles(fullPath, fn)
+			}
+			return more
+		}
+		matches := frameRe.FindStringSubmatch(f.Name())
+		if matches == nil || isMultiFrame(f.Name()) {
+			return true
+		}
+		frame, err := strconv.Atoi(matches[2])
+		if err != nil || !h.inFrameWindow(frame) {
+			return true
+		}
+		entry, ok := h.manifestEntry(p, fullPath)
+		key := entry.Key
+		if !ok {
+			key = h.imageKey(p, matches[1], fileKey)
+		}
+		more = fn(fullPath, FrameRef{Key: key, Frame: frame})
+		return more
+	})
+	if err != nil {
+		log.Print(fileLimitErr(err))
+	}
+	return more
+}
@@ -0,0 +1,55 @@
+package phash
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRehashByContent(t *testing.T) {
+	if err := CheckHashSupport(); err != nil {
+		t.Skip(err)
+	}
+	const frames = 6
+	dir := t.TempDir()
+	writeFrames(t, dir, frames)
+	h := &PHasher{
+		DBFile:             filepath.Join(t.TempDir(), "phash.db"),
+		DBTimeout:          30 * time.Second,
+		StoreContentHashes: true,
+		Quiet:              true,
+	}
+	if err := h.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	if summary := h.StoreHashesFromDirs([]string{dir}); summary.Stored != frames {
+		t.Fatalf("stored %d frames, want %d", summary.Stored, frames)
+	}
+	want := hashRows(t, h.DBFile)
+	db, err := sql.Open("sqlite3", h.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("update key_hashes set h1 = 0, h2 = 0, h3 = 0, h4 = 0")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := &PHasher{DBFile: h.DBFile, DBTimeout: h.DBTimeout, Grayscale: GrayAverage, Quiet: true}
+	if _, err := other.RehashByContent(dir); err == nil {
+		t.Error("rehashed with a different grayscale mode")
+	}
+	n, err := h.RehashByContent(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != frames {
+		t.Errorf("rehashed %d frames, want %d", n, frames)
+	}
+	if got := hashRows(t, h.DBFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+package phash
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+)
+
+// KeyMode selects how Rekey derives new keys from stored keys.
+type KeyMode int
+
+const (
+	// KeyKeep keeps each key, only normalizing it (see FoldKeys).
+	KeyKeep KeyMode = iota
+	// KeyDir uses the directory of each key, as KeyFromDir does for keys
+	// stored from filenames.
+	KeyDir
+)
+
+var keyModeNames = map[KeyMode]string{
+	KeyKeep: "keep",
+	KeyDir:  "dir",
+}
+
+func (m KeyMode) String() string {
+	if s, ok := keyModeNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("KeyMode(%d)", int(m))
+}
+
+// ParseKeyMode converts a key mode name ("keep", "dir") to a KeyMode.
+func ParseKeyMode(s string) (KeyMode, error) {
+	for m, name := range keyModeNames {
+		if name == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key mode %q", s)
+}
+
+// rekey returns the key 'mode' derives from stored key 'key'.
+func (h *PHasher) rekey(key string, mode KeyMode) string {
+	if mode == KeyDir {
+		key = path.Dir(key)
+	}
+	return h.normalizeKey(key)
+}
+
+// rekeyPrefix marks keys being renamed by Rekey, so a key can take the old
+// name of another without colliding midway.
+const rekeyPrefix = "\x01rekey:"
+
+const listAllKeysQuery = "select distinct fullpath from key_hashes where fullpath is not null"
+const createRekeyMapQuery = "CREATE TEMP TABLE rekey_map(old text primary key, new text)"
+const rekeyCollisionQuery = "select coalesce(m.new, k.fullpath) as key, k.frame from key_hashes k left join rekey_map m on m.old = k.fullpath group by key, k.frame having count(*) > 1 limit 1"
+
+// Rekey recomputes the key of every stored frame from its current key using
+// 'mode' and FoldKeys, in a single transaction, without reading any images.
+// Keys are derived from the stored keys alone, so only modes that discard
+// information are possible, e.g. from filename keys to KeyDir; keys from
+// KeyFile can't be recovered. It returns the number of keys changed. If two
+// keys would end up with the same frame, nothing is changed and an error
+// names the first collision; MergeKeys can resolve it first.
+func (h *PHasher) Rekey(mode KeyMode) (int, error) {
+	if _, ok := keyModeNames[mode]; !ok {
+		return 0, fmt.Errorf("unknown key mode %v", mode)
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createRekeyMapQuery); err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(h.tableQuery(listAllKeysQuery))
+	if err != nil {
+		return 0, err
+	}
+	renames := make(map[string]string)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if newKey := h.rekey(key, mode); newKey != key {
+			renames[key] = newKey
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(renames) == 0 {
+		return 0, nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO rekey_map(old, new) values(?,?)")
+	if err != nil {
+		return 0, err
+	}
+	for key, newKey := range renames {
+		if _, err := stmt.Exec(key, newKey); err != nil {
+			return 0, err
+		}
+	}
+	var key string
+	var frame int
+	err = tx.QueryRow(h.tableQuery(rekeyCollisionQuery)).Scan(&key, &frame)
+	if err == nil {
+		return 0, fmt.Errorf("rekeying would store frame %d of %q more than once", frame, key)
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	for _, table := range keyedTables {
+		table = h.tableQuery(table)
+		var n int
+		if err := tx.QueryRow(tableExistsQuery, table).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET fullpath = ? || (select new from rekey_map where old = fullpath) where fullpath in (select old from rekey_map)", table), rekeyPrefix); err != nil {
+			return 0, fmt.Errorf("%s: %v", table, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET fullpath = substr(fullpath, ?) where substr(fullpath, 1, ?) = ?", table), len(rekeyPrefix)+1, len(rekeyPrefix), rekeyPrefix); err != nil {
+			return 0, fmt.Errorf("%s: %v", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(renames), nil
+}
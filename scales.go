@@ -0,0 +1,76 @@
+package phash
+
+import (
+	"fmt"
+	stdimage "image"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// scalePrefix starts the names of scale variants.
+const scalePrefix = "scale-"
+
+// hasVariants reports whether any variant hashes are computed, so lookups
+// should search them.
+func (h *PHasher) hasVariants() bool {
+	return h.Orientations || h.Tiles > 1 || len(h.Scales) > 0 || (h.Anamorphic > 0 && h.Anamorphic != 1)
+}
+
+// scaleVariants returns hashes of 'img' resized by each of Scales other
+// than 1.
+func (h *PHasher) scaleVariants(img gocv.Mat) []Variant {
+	var result []Variant
+	for _, s := range h.Scales {
+		if s <= 0 || s == 1 {
+			continue
+		}
+		sz := stdimage.Pt(int(float64(img.Cols())*s+0.5), int(float64(img.Rows())*s+0.5))
+		if sz.X < 1 {
+			sz.X = 1
+		}
+		if sz.Y < 1 {
+			sz.Y = 1
+		}
+		scaled := gocv.NewMat()
+		gocv.Resize(img, &scaled, sz, 0, 0, gocv.InterpolationArea)
+		result = append(result, Variant{
+			Name: fmt.Sprintf("%s%g", scalePrefix, s),
+			Hash: h.hashMat(scaled),
+		})
+		scaled.Close()
+	}
+	return result
+}
+
+// mergeMatches adds 'more' to 'matches', keeping only the closest match for
+// each stored frame.
+func mergeMatches(matches, more []Match) []Match {
+	index := make(map[frameID]int, len(matches))
+	for i, m := range matches {
+		index[frameID{m.Key, m.Frame}] = i
+	}
+	for _, m := range more {
+		id := frameID{m.Key, m.Frame}
+		if i, ok := index[id]; ok {
+			if m.Distance < matches[i].Distance {
+				matches[i] = m
+			}
+			continue
+		}
+		index[id] = len(matches)
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// isScaleVariant reports whether 'v' is a hash from scaleVariants.
+func isScaleVariant(v Variant) bool {
+	return strings.HasPrefix(v.Name, scalePrefix)
+}
+
+// isLookupVariant reports whether queries also look up variant 'v' of the
+// input, i.e. it's a scale or anamorphic variant.
+func isLookupVariant(v Variant) bool {
+	return isScaleVariant(v) || v.Name == anamorphicName
+}
@@ -0,0 +1,87 @@
+package phash
+
+import (
+	"context"
+	"sort"
+)
+
+// SequenceMatch is a run of consecutive query hashes matching consecutive
+// stored frames of the same key.
+type SequenceMatch struct {
+	Key string
+	// QueryStart is the index of the first matching query hash.
+	QueryStart int
+	// FrameStart is the first matching stored frame.
+	FrameStart int
+	// Length is the number of consecutive matching frames.
+	Length int
+	// Distance is the total Hamming distance over the run.
+	Distance int
+}
+
+// MatchSequence looks up a sequence of frame hashes and returns runs of at
+// least two consecutive query hashes that match consecutive frames of the
+// same stored key, each within Hamming distance 'maxDist'. Requiring
+// temporal alignment greatly reduces false positives compared to isolated
+// frame matches. Runs are sorted longest first, then by total distance.
+func (h *PHasher) MatchSequence(hashes [][]byte, maxDist int) ([]SequenceMatch, error) {
+	st, release, err := h.openStore()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// found[i] maps stored frames matching hashes[i] to their distance.
+	found := make([]map[frameID]int, len(hashes))
+	for i, hash := range hashes {
+		matches, err := st.Lookup(context.Background(), hash, maxDist)
+		if err != nil {
+			return nil, err
+		}
+		found[i] = make(map[frameID]int, len(matches))
+		for _, m := range matches {
+			id := frameID{m.Key, m.Frame}
+			if d, ok := found[i][id]; !ok || m.Distance < d {
+				found[i][id] = m.Distance
+			}
+		}
+	}
+
+	var result []SequenceMatch
+	for i := range found {
+		for id, d := range found[i] {
+			// Only start runs that don't continue an earlier one.
+			if i > 0 {
+				if _, ok := found[i-1][frameID{id.key, id.frame - 1}]; ok {
+					continue
+				}
+			}
+			run := SequenceMatch{Key: id.key, QueryStart: i, FrameStart: id.frame, Length: 1, Distance: d}
+			for j := i + 1; j < len(found); j++ {
+				next, ok := found[j][frameID{id.key, id.frame + j - i}]
+				if !ok {
+					break
+				}
+				run.Length++
+				run.Distance += next
+			}
+			if run.Length >= 2 {
+				result = append(result, run)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Length != b.Length {
+			return a.Length > b.Length
+		}
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.FrameStart < b.FrameStart
+	})
+	return result, nil
+}
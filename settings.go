@@ -0,0 +1,126 @@
+package phash
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// createSettingsQuery creates the 'settings' table used by InitDB. It records
+// options that affect hashes, so that queries can verify they hash the same
+// way as the stored frames.
+const createSettingsQuery = "CREATE TABLE IF NOT EXISTS settings(name text primary key, value text)"
+const loadSettingsQuery = "select name, value from settings"
+const saveSettingQuery = "INSERT OR REPLACE INTO settings(name, value) values(?,?)"
+
+// settingsStore is implemented by Stores that record hash settings.
+type settingsStore interface {
+	Settings() (map[string]string, error)
+	SaveSettings(map[string]string) error
+}
+
+// hashSettings returns the options that affect computed hashes. Options at
+// their defaults have empty values.
+func (h *PHasher) hashSettings() map[string]string {
+	settings := map[string]string{"algorithm": hashAlgorithm, "crop": "", "grayscale": "", "hashlen": hashLenSetting(runtimeHashLen()), "reduce": ""}
+	if !h.CropRect.Empty() {
+		settings["crop"] = h.CropRect.String()
+	}
+	if h.Grayscale != GrayLuma {
+		settings["grayscale"] = h.Grayscale.String()
+	}
+	if h.Reduce > 1 {
+		settings["reduce"] = strconv.Itoa(h.Reduce)
+	}
+	return settings
+}
+
+// checkSettings verifies that the hash settings recorded in 'st' match
+// PHasher's. Settings missing from a DB that records any settings are taken
+// to be at their defaults; DBs that record none (e.g. built before settings
+// were recorded) are not checked. If 'save' is set, the current settings are
+// recorded. Stores that don't record settings are not checked. The width of
+// stored hashes is checked as well (see checkHashWidth).
+func (h *PHasher) checkSettings(st Store, save bool) error {
+	return checkStoredSettings(st, h.hashSettings(), save)
+}
+
+// checkStoredSettings is checkSettings for hash settings 'current'.
+func checkStoredSettings(st Store, current map[string]string, save bool) error {
+	if err := checkHashWidth(st); err != nil {
+		return err
+	}
+	ss, ok := st.(settingsStore)
+	if !ok {
+		return nil
+	}
+	stored, err := ss.Settings()
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		var names []string
+		for name := range current {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if stored[name] == current[name] {
+				continue
+			}
+			if name == "hashlen" {
+				n, _ := settingHashLen(current)
+				dbLen, _ := settingHashLen(stored)
+				return fmt.Errorf("OpenCV computes %d-byte hashes but the DB was built with %d-byte hashes; use an OpenCV build matching the DB", n, dbLen)
+			}
+			return fmt.Errorf("setting %q is %q but the DB was built with %q", name, current[name], stored[name])
+		}
+	}
+	if save {
+		return ss.SaveSettings(current)
+	}
+	return nil
+}
+
+// Settings returns the recorded hash settings. A DB without a 'settings'
+// table has none.
+func (s *SQLiteStore) Settings() (map[string]string, error) {
+	rows, err := s.db.Query(loadSettingsQuery)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	settings := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		settings[name] = value.String
+	}
+	return settings, rows.Err()
+}
+
+// SaveSettings records hash settings.
+func (s *SQLiteStore) SaveSettings(settings map[string]string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createSettingsQuery); err != nil {
+		return err
+	}
+	for name, value := range settings {
+		if _, err := tx.Exec(saveSettingQuery, name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
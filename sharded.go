@@ -0,0 +1,224 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyPlaceholder is replaced by a key in ShardedStore templates.
+const keyPlaceholder = "{key}"
+
+// ShardedStore is a Store that keeps each key's frames in a separate SQLite
+// DB, named by substituting the key for "{key}" in Template, e.g.
+// "db/{key}.sqlite". Path separators in keys are replaced with '_'. Shards
+// are created and initialized on first insert; lookups search every
+// existing shard matching the template, or only those of keys starting with
+// KeyPrefix.
+type ShardedStore struct {
+	Template string
+	// Variants, PageSize, Clustered, Metric, Conflict, and Table are passed
+	// to each shard's SQLiteStore.
+	Variants  bool
+	PageSize  int
+	Clustered bool
+	Metric    DistanceMetric
+	Conflict  ConflictPolicy
+	Table     string
+	// QueryProcs bounds the number of shards looked up concurrently. If
+	// it's not positive, runtime.NumCPU() is used.
+	QueryProcs int
+	// KeyPrefix, if set, restricts lookups to keys starting with it, and
+	// only opens their shards.
+	KeyPrefix string
+
+	open   func(file string) (*sql.DB, error)
+	mu     sync.Mutex
+	shards map[string]*SQLiteStore
+	dbs    []*sql.DB
+}
+
+// NewShardedStore returns a ShardedStore that opens shard files with
+// 'open'.
+func NewShardedStore(template string, open func(file string) (*sql.DB, error)) *ShardedStore {
+	return &ShardedStore{
+		Template: template,
+		open:     open,
+		shards:   make(map[string]*SQLiteStore),
+	}
+}
+
+// shardFile returns the DB file for 'key'.
+func (s *ShardedStore) shardFile(key string) string {
+	name := shardName(key)
+	if name == "" {
+		name = "_"
+	}
+	return strings.Replace(s.Template, keyPlaceholder, name, -1)
+}
+
+// shardName returns 'key' with path separators replaced.
+func shardName(key string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(key)
+}
+
+// shard returns the store for DB file 'file', opening it, and initializing
+// it if 'create' is set.
+func (s *ShardedStore) shard(file string, create bool) (*SQLiteStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.shards[file]; ok {
+		return st, nil
+	}
+	db, err := s.open(file)
+	if err != nil {
+		return nil, err
+	}
+	st := NewSQLiteStore(db)
+	st.Variants = s.Variants
+	st.PageSize = s.PageSize
+	st.Clustered = s.Clustered
+	st.Conflict = s.Conflict
+	st.Table = s.Table
+	st.Metric = s.Metric
+	if err := st.loadHashWords(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if create {
+		if err := st.Init(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s.dbs = append(s.dbs, db)
+	s.shards[file] = st
+	return st, nil
+}
+
+// files returns the existing shard files, or only those whose keys could
+// start with KeyPrefix.
+func (s *ShardedStore) files() ([]string, error) {
+	pattern := "*"
+	if s.KeyPrefix != "" {
+		pattern = globEscaper.Replace(shardName(s.KeyPrefix)) + "*"
+	}
+	return filepath.Glob(strings.Replace(s.Template, keyPlaceholder, pattern, -1))
+}
+
+// globEscaper escapes filepath.Match metacharacters.
+var globEscaper = strings.NewReplacer("*", "\\*", "?", "\\?", "[", "\\[", "\\", "\\\\")
+
+// Init initializes the existing shards.
+func (s *ShardedStore) Init() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := s.shard(file, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert stores each result in its key's shard, with one transaction per
+// shard.
+func (s *ShardedStore) Insert(results []Result) (int, error) {
+	byFile := make(map[string][]Result)
+	for _, r := range results {
+		file := s.shardFile(r.Key)
+		byFile[file] = append(byFile[file], r)
+	}
+	files := make([]string, 0, len(byFile))
+	for file := range byFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	stored := 0
+	for _, file := range files {
+		st, err := s.shard(file, true)
+		if err != nil {
+			return stored, err
+		}
+		n, err := st.Insert(byFile[file])
+		stored += n
+		if err != nil {
+			return stored, err
+		}
+	}
+	return stored, nil
+}
+
+// Lookup returns matches from every existing shard, or those of KeyPrefix,
+// looking up to QueryProcs shards at once. Matches are merged in shard order,
+// keeping the closest match for each frame.
+func (s *ShardedStore) Lookup(ctx context.Context, hash []byte, maxDist int) ([]Match, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	procs := s.QueryProcs
+	if procs <= 0 {
+		procs = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make([][]Match, len(files))
+	var errOnce sync.Once
+	var firstErr error
+	sem := make(chan struct{}, procs)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, file string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			st, err := s.shard(file, false)
+			if err == nil {
+				found[i], err = st.Lookup(ctx, hash, maxDist)
+			}
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(i, file)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	var matches []Match
+	for i := range files {
+		for _, m := range found[i] {
+			if strings.HasPrefix(m.Key, s.KeyPrefix) {
+				matches = append(matches, m)
+			}
+		}
+	}
+	return mergeMatches(nil, matches), nil
+}
+
+// Close closes every opened shard.
+func (s *ShardedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.shards {
+		st.closeStmts()
+	}
+	var err error
+	for _, db := range s.dbs {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.dbs = nil
+	s.shards = make(map[string]*SQLiteStore)
+	return err
+}
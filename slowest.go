@@ -0,0 +1,59 @@
+package phash
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ImageTiming is the time taken to hash one frame.
+type ImageTiming struct {
+	Path   string
+	Frame  int
+	Width  int
+	Height int
+	Hash   time.Duration
+}
+
+func (t ImageTiming) String() string {
+	return fmt.Sprintf("%s:%d(%dx%d)=%v", t.Path, t.Frame, t.Width, t.Height, t.Hash)
+}
+
+// timingHeap is a min-heap of timings, so the fastest of the slowest frames
+// seen so far is at the root.
+type timingHeap []ImageTiming
+
+func (t timingHeap) Len() int            { return len(t) }
+func (t timingHeap) Less(i, j int) bool  { return t[i].Hash < t[j].Hash }
+func (t timingHeap) Swap(i, j int)       { t[i], t[j] = t[j], t[i] }
+func (t *timingHeap) Push(x interface{}) { *t = append(*t, x.(ImageTiming)) }
+func (t *timingHeap) Pop() interface{} {
+	old := *t
+	x := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return x
+}
+
+// recordTiming keeps 'timing' if it's among the 'n' slowest seen.
+func (s *runStats) recordTiming(timing ImageTiming, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.slowest) < n {
+		heap.Push(&s.slowest, timing)
+	} else if timing.Hash > s.slowest[0].Hash {
+		s.slowest[0] = timing
+		heap.Fix(&s.slowest, 0)
+	}
+}
+
+// slowestTimings returns the recorded timings, slowest first. The caller
+// must hold mu.
+func (s *runStats) slowestTimings() []ImageTiming {
+	if len(s.slowest) == 0 {
+		return nil
+	}
+	result := append([]ImageTiming(nil), s.slowest...)
+	sort.Slice(result, func(i, j int) bool { return result[i].Hash > result[j].Hash })
+	return result
+}
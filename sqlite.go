@@ -0,0 +1,304 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SQLiteStore is a Store backed by the 'key_hashes' table of a SQLite DB,
+// with optional 'thumbnails', 'key_hash_variants', 'content_hashes', and
+// 'frame_metadata' tables. Its queries are built for the number of hash word
+// columns of its tables, detected when it's opened: a new table gets one
+// per 4 bytes of the hashes OpenCV computes, up to storedHashWords.
+type SQLiteStore struct {
+	// Variants includes the 'key_hash_variants' table in lookups.
+	Variants bool
+	// PageSize, if positive, sets the page size of a new DB in Init. It
+	// can't be changed once the DB has been written to.
+	PageSize int
+	// Clustered creates 'key_hashes' as a WITHOUT ROWID table clustered by
+	// (fullpath, frame) in Init, and inserts each batch in that order.
+	Clustered bool
+	// Metric is used to compute distances for fuzzy lookups.
+	Metric DistanceMetric
+	// Conflict handles frames already stored with a different hash.
+	Conflict ConflictPolicy
+	// Table is the hash table, 'key_hashes' if empty (see PHasher.Table).
+	// It must be a valid table name.
+	Table string
+
+	db *sql.DB
+	// number of hash word columns of Table, detected once by loadHashWords
+	wordsOnce sync.Once
+	words     int
+	wordsErr  error
+	// lookup statements, prepared once and shared by concurrent lookups, and
+	// queries rewritten by tableQuery
+	stmtMu  sync.Mutex
+	stmts   map[string]*sql.Stmt
+	queries map[string]string
+}
+
+// NewSQLiteStore returns a SQLiteStore using 'db'.
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// Init creates the hash tables if they don't already exist, first setting
+// PageSize if the DB is new.
+func (s *SQLiteStore) Init() error {
+	if err := s.loadHashWords(); err != nil {
+		return err
+	}
+	// page_size only applies to the connection that creates the DB, so use a
+	// single connection throughout.
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.PageSize > 0 {
+		var tables, pageSize int
+		if err := conn.QueryRowContext(ctx, "select count(*) from sqlite_master").Scan(&tables); err != nil {
+			return err
+		}
+		if err := conn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+			return err
+		}
+		if tables > 0 && pageSize != s.PageSize {
+			log.Printf("DB already exists with page size %d; ignoring page size %d (run VACUUM to change it)", pageSize, s.PageSize)
+		} else if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA page_size = %d", s.PageSize)); err != nil {
+			return err
+		}
+	}
+	table := createTableQuery
+	if s.Clustered {
+		table = createClusteredTableQuery
+	}
+	for _, q := range []string{table, createThumbnailsQuery, createVariantsQuery, createSettingsQuery, createRehashedQuery, createContentHashesQuery, createMetadataQuery} {
+		if _, err := conn.ExecContext(ctx, s.tableQuery(q)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueErr reports whether 'err' is a unique constraint violation.
+func isUniqueErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// Insert stores 'results' in a single transaction. Frames whose (key, frame)
+// is already stored are handled according to Conflict; replaced frames count
+// as stored.
+func (s *SQLiteStore) Insert(results []Result) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(s.tableQuery(insertHashesQuery))
+	if err != nil {
+		return 0, err
+	}
+	if s.Clustered {
+		results = append([]Result(nil), results...)
+		sort.Slice(results, func(i, j int) bool {
+			if results[i].Key != results[j].Key {
+				return results[i].Key < results[j].Key
+			}
+			return results[i].Frame < results[j].Frame
+		})
+	}
+	var thumbStmt, variantStmt, contentStmt, metadataStmt *sql.Stmt
+	stored := 0
+	for _, r := range results {
+		// TODO: put this inner loop code in a function
+		un := s.unpack(r.Hash)
+		_, err = stmt.Exec(append([]interface{}{r.Key, r.Frame}, wordArgs(un)...)...)
+		if err != nil && !isUniqueErr(err) {
+			return 0, err
+		}
+		if err != nil {
+			replaced, err := s.resolveConflict(tx, r, un)
+			if err != nil {
+				return 0, err
+			}
+			if replaced {
+				stored++
+			}
+		} else {
+			stored++
+		}
+		for _, v := range r.Variants {
+			if variantStmt == nil {
+				variantStmt, err = tx.Prepare(s.tableQuery(s.insertQuery(insertVariantQuery)))
+				if err != nil {
+					return 0, err
+				}
+			}
+			_, err = variantStmt.Exec(append([]interface{}{r.Key, r.Frame, v.Name}, wordArgs(s.unpack(v.Hash))...)...)
+			if err != nil && !isUniqueErr(err) {
+				return 0, err
+			}
+		}
+		if r.Thumbnail != nil {
+			if thumbStmt == nil {
+				thumbStmt, err = tx.Prepare(s.insertQuery(insertThumbnailQuery))
+				if err != nil {
+					return 0, err
+				}
+			}
+			_, err = thumbStmt.Exec(r.Key, r.Frame, r.Thumbnail)
+			if err != nil && !isUniqueErr(err) {
+				return 0, err
+			}
+		}
+		if r.ContentHash != nil {
+			if contentStmt == nil {
+				contentStmt, err = tx.Prepare(s.insertQuery(insertContentHashQuery))
+				if err != nil {
+					return 0, err
+				}
+			}
+			_, err = contentStmt.Exec(r.Key, r.Frame, hex.EncodeToString(r.ContentHash))
+			if err != nil && !isUniqueErr(err) {
+				return 0, err
+			}
+		}
+		for name, value := range r.Metadata {
+			if metadataStmt == nil {
+				metadataStmt, err = tx.Prepare(s.insertQuery(insertMetadataQuery))
+				if err != nil {
+					return 0, err
+				}
+			}
+			_, err = metadataStmt.Exec(r.Key, r.Frame, name, value)
+			if err != nil && !isUniqueErr(err) {
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return stored, nil
+}
+
+const scanAllHashesQuery = "select fullpath, frame, h1, h2, h3, h4 from key_hashes"
+const scanAllVariantsQuery = "select fullpath, frame, h1, h2, h3, h4 from key_hash_variants"
+
+// Lookup returns stored frames matching 'hash'. Exact lookups (maxDist 0)
+// use an equality query; fuzzy lookups scan every stored hash. It's safe to
+// call concurrently.
+func (s *SQLiteStore) Lookup(ctx context.Context, hash []byte, maxDist int) ([]Match, error) {
+	if err := checkHashLen(hash); err != nil {
+		return nil, err
+	}
+	var matches []Match
+	if maxDist <= 0 {
+		un := s.unpack(hash)
+		queries := []string{lookupHashesQuery}
+		if s.Variants {
+			queries = append(queries, lookupVariantsQuery)
+		}
+		for _, q := range queries {
+			found, err := s.queryMatches(ctx, q, wordArgs(un)...)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, found...)
+		}
+	} else {
+		err := s.scanWithin(ctx, hash, maxDist, func(m Match) { matches = append(matches, m) })
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A frame matching through both its hash and a variant is one match.
+	matches = mergeMatches(nil, matches)
+	return matches, s.addMetadata(ctx, matches)
+}
+
+// queryMatches runs query 'q', which selects fullpath and frame, with 'args'.
+func (s *SQLiteStore) queryMatches(ctx context.Context, q string, args ...interface{}) ([]Match, error) {
+	stmt, err := s.stmt(ctx, s.tableQuery(q))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []Match
+	nulls := 0
+	defer func() { logNullRows(nulls) }()
+	for rows.Next() {
+		var row hashRow
+		if err := rows.Scan(row.dest(0)...); err != nil {
+			return nil, err
+		}
+		if !row.valid() {
+			nulls++
+			continue
+		}
+		matches = append(matches, row.match(nil))
+	}
+	return matches, rows.Err()
+}
+
+// scanWithin scans every stored hash, including variants if Variants is set,
+// passing those within 'maxDist' of 'hash' to 'fn'.
+func (s *SQLiteStore) scanWithin(ctx context.Context, hash []byte, maxDist int, fn func(Match)) error {
+	un := s.unpack(hash)
+	queries := []string{scanAllHashesQuery}
+	if s.Variants {
+		queries = append(queries, scanAllVariantsQuery)
+	}
+	nulls := 0
+	defer func() { logNullRows(nulls) }()
+	stored := make([]uint32, len(un))
+	for _, q := range queries {
+		stmt, err := s.stmt(ctx, s.tableQuery(q))
+		if err != nil {
+			return err
+		}
+		rows, err := stmt.QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var row hashRow
+			if err := rows.Scan(row.dest(len(un))...); err != nil {
+				rows.Close()
+				return err
+			}
+			if !row.valid() {
+				nulls++
+				continue
+			}
+			m := row.match(stored)
+			m.Distance, err = metricDistance(s.Metric, hash, un, stored)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if m.Distance <= maxDist {
+				fn(m)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package phash
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// stageBuckets is the number of histogram buckets in a StageTiming.
+const stageBuckets = 32
+
+// StageTiming aggregates the time spent in one pipeline stage.
+type StageTiming struct {
+	// Count is the number of timed operations, and Total their combined
+	// duration. Stages run concurrently, so totals can exceed Elapsed.
+	Count int64
+	Total time.Duration
+	// Buckets is an exponential histogram of durations: Buckets[0] counts
+	// operations shorter than 2µs, and Buckets[i] those from 2^i to
+	// 2^(i+1) µs.
+	Buckets [stageBuckets]int64
+}
+
+// Mean returns the mean duration of the stage's operations.
+func (t StageTiming) Mean() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Total / time.Duration(t.Count)
+}
+
+func (t StageTiming) String() string {
+	return fmt.Sprintf("%v/%d", t.Total, t.Count)
+}
+
+// stageTimer accumulates a StageTiming concurrently.
+type stageTimer struct {
+	count   int64
+	total   int64
+	buckets [stageBuckets]int64
+}
+
+// since records an operation that started at 'start'.
+func (t *stageTimer) since(start time.Time) {
+	d := time.Since(start)
+	atomic.AddInt64(&t.count, 1)
+	atomic.AddInt64(&t.total, int64(d))
+	b := 0
+	if us := uint64(d / time.Microsecond); us > 1 {
+		b = bits.Len64(us) - 1
+	}
+	if b >= stageBuckets {
+		b = stageBuckets - 1
+	}
+	atomic.AddInt64(&t.buckets[b], 1)
+}
+
+func (t *stageTimer) timing() StageTiming {
+	result := StageTiming{
+		Count: atomic.LoadInt64(&t.count),
+		Total: time.Duration(atomic.LoadInt64(&t.total)),
+	}
+	for i := range t.buckets {
+		result.Buckets[i] = atomic.LoadInt64(&t.buckets[i])
+	}
+	return result
+}
@@ -0,0 +1,36 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+)
+
+// stmt returns a prepared statement for query 'q', preparing it on first
+// use. Statements are shared by concurrent lookups: *sql.Stmt is safe for
+// concurrent use, and the pool gives each execution its own connection.
+func (s *SQLiteStore) stmt(ctx context.Context, q string) (*sql.Stmt, error) {
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	if st, ok := s.stmts[q]; ok {
+		return st, nil
+	}
+	st, err := s.db.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if s.stmts == nil {
+		s.stmts = make(map[string]*sql.Stmt)
+	}
+	s.stmts[q] = st
+	return st, nil
+}
+
+// closeStmts closes the statements prepared by stmt.
+func (s *SQLiteStore) closeStmts() {
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	for _, st := range s.stmts {
+		st.Close()
+	}
+	s.stmts = nil
+}
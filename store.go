@@ -0,0 +1,134 @@
+package phash
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Result is a hashed frame to be stored.
+type Result struct {
+	Key   string
+	Frame int
+	// Path is the path of the hashed image.
+	Path string
+	Hash []byte
+	// Variants are hashes of transformed copies of the image, if any.
+	Variants []Variant
+	// Thumbnail is a JPEG preview of the image, if any.
+	Thumbnail []byte
+	// ContentHash is the SHA-256 of the image file, if any.
+	ContentHash []byte
+	// Metadata is stored with the frame and returned with matches, if any.
+	Metadata map[string]string
+}
+
+// Variant is the hash of a transformed copy of an image, tagged with the
+// name of the transformation.
+type Variant struct {
+	Name string
+	Hash []byte
+}
+
+// Store stores frame hashes and looks them up. PHasher uses a SQLiteStore
+// on DBFile unless its Store is set. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Init prepares the store for use, e.g. by creating tables.
+	Init() error
+	// Insert stores 'results' and returns the number stored. Frames that
+	// are already stored are not counted.
+	Insert(results []Result) (int, error)
+	// Lookup returns stored frames, including variants, whose hash is
+	// within Hamming distance 'maxDist' of 'hash'.
+	Lookup(ctx context.Context, hash []byte, maxDist int) ([]Match, error)
+}
+
+// openStore returns the store opened by OpenHasher, Store, or if it's unset
+// an AttachedStore on LookupDBs, a ShardedStore on DBTemplate, or a
+// SQLiteStore on DBFile, and a function to release it.
+func (h *PHasher) openStore() (Store, func(), error) {
+	if h.store != nil {
+		return h.store, func() {}, nil
+	}
+	if h.Store != nil {
+		return h.Store, func() {}, nil
+	}
+	if len(h.LookupDBs) > 0 {
+		return h.openAttachedStore()
+	}
+	if h.DBTemplate != "" {
+		s := NewShardedStore(h.DBTemplate, h.openDBFile)
+		s.Variants = h.hasVariants()
+		s.PageSize = h.PageSize
+		s.Clustered = h.Clustered
+		s.Conflict = h.Conflict
+		s.Table = h.Table
+		s.Metric = h.DistanceMetric
+		s.QueryProcs = h.QueryProcs
+		s.KeyPrefix = h.KeyPrefix
+		return s, func() { s.Close() }, nil
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	s := NewSQLiteStore(db)
+	s.Variants = h.hasVariants()
+	s.PageSize = h.PageSize
+	s.Clustered = h.Clustered
+	s.Conflict = h.Conflict
+	s.Table = h.Table
+	s.Metric = h.DistanceMetric
+	if err := s.loadHashWords(); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return s, func() {
+		s.closeStmts()
+		db.Close()
+	}, nil
+}
+
+// openAttachedStore returns an AttachedStore on DBFile, if set, and
+// LookupDBs, inserting into DBFile.
+func (h *PHasher) openAttachedStore() (Store, func(), error) {
+	files := h.LookupDBs
+	var primary *SQLiteStore
+	var primaryDB *sql.DB
+	if h.DBFile != "" {
+		files = append([]string{h.DBFile}, files...)
+		db, err := h.openDB()
+		if err != nil {
+			return nil, nil, err
+		}
+		primaryDB = db
+		primary = NewSQLiteStore(db)
+		primary.Variants = h.hasVariants()
+		primary.PageSize = h.PageSize
+		primary.Clustered = h.Clustered
+		primary.Conflict = h.Conflict
+		primary.Table = h.Table
+		primary.Metric = h.DistanceMetric
+		if err := primary.loadHashWords(); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+	s, err := NewAttachedStore(files, h.openDBFile)
+	if err != nil {
+		if primaryDB != nil {
+			primaryDB.Close()
+		}
+		return nil, nil, err
+	}
+	s.Primary = primary
+	s.Variants = h.hasVariants()
+	s.Metric = h.DistanceMetric
+	s.Table = h.Table
+	return s, func() {
+		s.Close()
+		if primaryDB != nil {
+			primaryDB.Close()
+		}
+	}, nil
+}
@@ -0,0 +1,71 @@
+package phash
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// StoreNewHashesFromDirs hashes images in 'paths' and stores only those with
+// no stored frame, or frame stored earlier in the same run, within
+// MaxDistance, building a deduplicated index in a single pass. Images whose
+// lookup fails are not stored. Unlike StoreHashesFromDirs it may be run
+// against a non-empty DB without Since or Force.
+func (h *PHasher) StoreNewHashesFromDirs(paths []string) Summary {
+	unlock, err := h.lockStore()
+	if err != nil {
+		log.Print(err)
+		return Summary{}
+	}
+	defer unlock()
+	return h.pipeline(paths, storeNew)
+}
+
+// isNew reports whether 'img' matches no frame in 'm', and if so adds it to
+// 'm'. 'm' is never flushed: it only remembers the frames accepted so far in
+// this run, which the caller stores.
+func (h *PHasher) isNew(m *Matcher, img *image, stats *runStats) bool {
+	ctx := context.Background()
+	if h.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.QueryTimeout)
+		defer cancel()
+	}
+	var matches []Match
+	retries, err := retry(func() error {
+		var err error
+		matches, err = m.QueryContext(ctx, img.hash, h.MaxDistance)
+		return err
+	}, h.DBTimeout)
+	atomic.AddInt64(&stats.retries, int64(retries))
+	if err != nil {
+		log.Printf("lookup of %q: %v", img.path, err)
+		stats.skip(skipLookupFailed)
+		return false
+	}
+	atomic.AddInt64(&stats.queried, 1)
+	atomic.AddInt64(&stats.matches, int64(len(matches)))
+	if len(matches) > 0 {
+		h.debugf("%q matches %v frame %v", img.path, matches[0].Key, matches[0].Frame)
+		stats.skip(skipDuplicate)
+		return false
+	}
+	m.add(img.result())
+	return true
+}
+
+// storeNewHashes stores the images read over 'dbC' that isNew accepts.
+func (h *PHasher) storeNewHashes(dbC chan *image, st Store, wg *sync.WaitGroup, stats *runStats) {
+	newC := make(chan *image)
+	go func() {
+		defer close(newC)
+		seen := NewMatcher(st)
+		for img := range dbC {
+			if h.isNew(seen, img, stats) {
+				newC <- img
+			}
+		}
+	}()
+	h.storeHashes(newC, st, wg, stats)
+}
@@ -0,0 +1,150 @@
+package phash
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Summary describes a single pipeline run.
+type Summary struct {
+	// Files is the number of directory entries seen.
+	Files int64
+	// Hashed is the number of images hashed.
+	Hashed int64
+	// Skipped counts files that weren't hashed, by reason.
+	Skipped map[string]int64
+	// Stored is the number of frames inserted in store mode.
+	Stored int64
+	// Existing is the number of frames not inserted in store mode because
+	// they were already in the DB.
+	Existing int64
+	// Commits is the number of batches committed in store mode. Retries is
+	// the number of commits and lookups retried because the DB was locked, and
+	// FailedCommits the number of batches that couldn't be committed. Many
+	// retries suggest enabling WAL or reducing HashProcs.
+	Commits       int64
+	Retries       int64
+	FailedCommits int64
+	// Queried is the number of images looked up in query mode.
+	Queried int64
+	// Matches is the total number of stored frames matched in query mode.
+	Matches int64
+	// Nondeterministic is the number of images dropped by CheckDeterminism.
+	Nondeterministic int64
+	// Slowest are the frames that took longest to hash, slowest first, if
+	// SlowestImages is set.
+	Slowest []ImageTiming
+	// Read, Hash, and Store time reading and decoding images, hashing them,
+	// and committing batches (including retries).
+	Read    StageTiming
+	Hash    StageTiming
+	Store   StageTiming
+	Elapsed time.Duration
+}
+
+func (s Summary) String() string {
+	var skipped []string
+	for reason, n := range s.Skipped {
+		skipped = append(skipped, fmt.Sprintf("%s=%d", reason, n))
+	}
+	sort.Strings(skipped)
+	var slowest string
+	if len(s.Slowest) > 0 {
+		parts := make([]string, len(s.Slowest))
+		for i, t := range s.Slowest {
+			parts[i] = t.String()
+		}
+		slowest = fmt.Sprintf(" slowest=[%s]", strings.Join(parts, " "))
+	}
+	return fmt.Sprintf("files=%d hashed=%d skipped=[%s] stored=%d existing=%d commits=%d retries=%d failed-commits=%d queried=%d matches=%d nondeterministic=%d read=%v hash=%v store=%v elapsed=%v",
+		s.Files, s.Hashed, strings.Join(skipped, " "), s.Stored, s.Existing,
+		s.Commits, s.Retries, s.FailedCommits, s.Queried, s.Matches,
+		s.Nondeterministic, s.Read, s.Hash, s.Store, s.Elapsed) + slowest
+}
+
+// Reasons files are skipped.
+const (
+	skipNotFrame      = "not-frame"
+	skipBadFrame      = "bad-frame"
+	skipEmpty         = "empty"
+	skipOld           = "older-than-since"
+	skipScene         = "same-scene"
+	skipCrop          = "crop-outside"
+	skipSmall         = "too-small"
+	skipPreprocess    = "preprocess-failed"
+	skipDuplicate     = "duplicate"
+	skipLookupFailed  = "lookup-failed"
+	skipCheckpoint    = "checkpointed"
+	skipExcludedDir   = "excluded-dir"
+	skipOutsideFrames = "outside-frames"
+)
+
+// runStats accumulates a Summary concurrently.
+type runStats struct {
+	start    time.Time
+	files    int64
+	hashed   int64
+	stored   int64
+	existing int64
+	commits  int64
+	retries  int64
+	failed   int64
+	queried  int64
+	matches  int64
+
+	nondeterministic int64
+
+	read  stageTimer
+	hash  stageTimer
+	store stageTimer
+
+	mu      sync.Mutex
+	skipped map[string]int64
+	// commits and time since the last WAL checkpoint (see checkpointWAL)
+	walCommits      int
+	walCheckpointed time.Time
+	// slowest frames to hash, if SlowestImages is set
+	slowest timingHeap
+}
+
+func newRunStats() *runStats {
+	now := time.Now()
+	return &runStats{start: now, skipped: make(map[string]int64), walCheckpointed: now}
+}
+
+func (s *runStats) skip(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped[reason]++
+}
+
+func (s *runStats) summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	skipped := make(map[string]int64, len(s.skipped))
+	for k, v := range s.skipped {
+		skipped[k] = v
+	}
+	return Summary{
+		Files:            atomic.LoadInt64(&s.files),
+		Hashed:           atomic.LoadInt64(&s.hashed),
+		Skipped:          skipped,
+		Stored:           atomic.LoadInt64(&s.stored),
+		Existing:         atomic.LoadInt64(&s.existing),
+		Commits:          atomic.LoadInt64(&s.commits),
+		Retries:          atomic.LoadInt64(&s.retries),
+		FailedCommits:    atomic.LoadInt64(&s.failed),
+		Queried:          atomic.LoadInt64(&s.queried),
+		Matches:          atomic.LoadInt64(&s.matches),
+		Nondeterministic: atomic.LoadInt64(&s.nondeterministic),
+		Slowest:          s.slowestTimings(),
+		Read:             s.read.timing(),
+		Hash:             s.hash.timing(),
+		Store:            s.store.timing(),
+		Elapsed:          time.Since(s.start),
+	}
+}
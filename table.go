@@ -0,0 +1,68 @@
+package phash
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultTable is the hash table used if Table is unset.
+const defaultTable = "key_hashes"
+
+// tableNameRe matches table names that are safe to use unquoted in queries.
+var tableNameRe = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// sharedTables are the tables shared by all hash tables in a DB, which
+// can't be used as hash tables.
+var sharedTables = []string{"thumbnails", "settings", "content_hashes", "frame_metadata", "rehashed_frames"}
+
+// checkTableName returns an error if 'table' isn't empty or a plain SQL
+// identifier. Table names are interpolated into queries, so anything else is
+// refused rather than escaped. Names of shared tables, and names ending in
+// "_variants", which would collide with another hash table's variants, are
+// refused too.
+func checkTableName(table string) error {
+	lower := strings.ToLower(table)
+	if table != "" && (!tableNameRe.MatchString(table) || strings.HasPrefix(lower, "sqlite_")) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+	if strings.HasSuffix(lower, "_variants") {
+		return fmt.Errorf("table name %q is reserved for variants", table)
+	}
+	for _, shared := range sharedTables {
+		if lower == shared {
+			return fmt.Errorf("table name %q is reserved", table)
+		}
+	}
+	return nil
+}
+
+// tableQuery rewrites query 'q', written against the default tables, to use
+// hash table 'table' and its variants table, 'table'+"_variants". Other
+// tables, e.g. 'thumbnails', are shared by all hash tables in a DB.
+func tableQuery(q, table string) string {
+	if table == "" || table == defaultTable {
+		return q
+	}
+	return strings.NewReplacer(defaultTable, table, "key_hash_variants", table+"_variants").Replace(q)
+}
+
+// tableQuery rewrites 'q' for Table.
+func (h *PHasher) tableQuery(q string) string { return tableQuery(q, h.Table) }
+
+// tableQuery rewrites 'q' for Table and its hash columns (see hashQuery),
+// caching the result.
+func (s *SQLiteStore) tableQuery(q string) string {
+	words := s.hashWords()
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	if tq, ok := s.queries[q]; ok {
+		return tq
+	}
+	if s.queries == nil {
+		s.queries = make(map[string]string)
+	}
+	tq := tableQuery(hashQuery(q, words), s.Table)
+	s.queries[q] = tq
+	return tq
+}
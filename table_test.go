@@ -0,0 +1,16 @@
+package phash
+
+import "testing"
+
+func TestCheckTableName(t *testing.T) {
+	for _, table := range []string{"", "key_hashes", "faces", "Frames_2"} {
+		if err := checkTableName(table); err != nil {
+			t.Errorf("%q: %v", table, err)
+		}
+	}
+	for _, table := range []string{"1x", "a b", "x;drop", "sqlite_master", "thumbnails", "Settings", "content_hashes", "frame_metadata", "rehashed_frames", "key_hash_variants", "faces_variants"} {
+		if err := checkTableName(table); err == nil {
+			t.Errorf("%q: accepted", table)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package phash
+
+// ThresholdReport describes how well a MaxDistance threshold separates
+// labeled pairs of hashes. A pair is predicted to be the same image if its
+// distance is at most Threshold.
+type ThresholdReport struct {
+	Threshold int
+	// TruePositives are same pairs within Threshold, FalsePositives are
+	// different pairs within it, and FalseNegatives are same pairs beyond it.
+	TruePositives  int
+	FalsePositives int
+	FalseNegatives int
+	Precision      float64
+	Recall         float64
+	F1             float64
+	// SameMax is the largest distance between same pairs, and DiffMin the
+	// smallest between different pairs, or -1 if there are none.
+	SameMax int
+	DiffMin int
+	// Separable is set if every same pair is closer than every different
+	// pair, so some threshold classifies all pairs correctly.
+	Separable bool
+}
+
+// SuggestThreshold returns the MaxDistance that best separates 'samePairs',
+// pairs of hashes of the same image, from 'diffPairs', pairs of different
+// images, by maximizing F1. Of equally good thresholds, the middle one is
+// chosen, leaving the most margin on either side; for separable pairs, it's
+// about halfway between SameMax and DiffMin.
+func SuggestThreshold(samePairs, diffPairs [][2][]byte) (threshold int, report ThresholdReport) {
+	maxDist := 0
+	distances := func(pairs [][2][]byte) []int {
+		d := make([]int, len(pairs))
+		for i, p := range pairs {
+			d[i] = HammingDistance(p[0], p[1])
+			if d[i] > maxDist {
+				maxDist = d[i]
+			}
+		}
+		return d
+	}
+	same, diff := distances(samePairs), distances(diffPairs)
+	// cumulative counts of pairs within each distance
+	sameWithin := make([]int, maxDist+1)
+	diffWithin := make([]int, maxDist+1)
+	for _, d := range same {
+		sameWithin[d]++
+	}
+	for _, d := range diff {
+		diffWithin[d]++
+	}
+	for t := 1; t <= maxDist; t++ {
+		sameWithin[t] += sameWithin[t-1]
+		diffWithin[t] += diffWithin[t-1]
+	}
+
+	reports := make([]ThresholdReport, maxDist+1)
+	best := 0.0
+	for t := range reports {
+		r := ThresholdReport{
+			Threshold:      t,
+			TruePositives:  sameWithin[t],
+			FalsePositives: diffWithin[t],
+			FalseNegatives: len(same) - sameWithin[t],
+		}
+		if r.TruePositives > 0 {
+			r.Precision = float64(r.TruePositives) / float64(r.TruePositives+r.FalsePositives)
+			r.Recall = float64(r.TruePositives) / float64(len(same))
+			r.F1 = 2 * r.Precision * r.Recall / (r.Precision + r.Recall)
+		}
+		if r.F1 > best {
+			best = r.F1
+		}
+		reports[t] = r
+	}
+	var plateau []int
+	for t, r := range reports {
+		if r.F1 == best {
+			plateau = append(plateau, t)
+		}
+	}
+	report = reports[plateau[len(plateau)/2]]
+
+	report.SameMax, report.DiffMin = -1, -1
+	for _, d := range same {
+		if d > report.SameMax {
+			report.SameMax = d
+		}
+	}
+	for _, d := range diff {
+		if report.DiffMin < 0 || d < report.DiffMin {
+			report.DiffMin = d
+		}
+	}
+	report.Separable = len(same) > 0 && len(diff) > 0 && report.SameMax < report.DiffMin
+	return report.Threshold, report
+}
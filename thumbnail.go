@@ -0,0 +1,54 @@
+package phash
+
+import (
+	stdimage "image"
+
+	"gocv.io/x/gocv"
+)
+
+// thumbnailSize is the maximum width and height of stored thumbnails.
+const thumbnailSize = 64
+
+// createThumbnailsQuery creates the 'thumbnails' table used by InitDB.
+const createThumbnailsQuery = "CREATE TABLE IF NOT EXISTS thumbnails(fullpath text, frame integer, thumbnail blob, UNIQUE(fullpath, frame))"
+const insertThumbnailQuery = "INSERT INTO thumbnails(fullpath, frame, thumbnail) values(?,?,?)"
+const lookupThumbnailQuery = "select thumbnail from thumbnails where fullpath = ? and frame = ?"
+
+// makeThumbnail returns a JPEG of 'img' scaled to fit within
+// thumbnailSize x thumbnailSize.
+func makeThumbnail(img gocv.Mat) ([]byte, error) {
+	rows, cols := img.Rows(), img.Cols()
+	scale := float64(thumbnailSize) / float64(rows)
+	if cols > rows {
+		scale = float64(thumbnailSize) / float64(cols)
+	}
+	sz := stdimage.Pt(int(float64(cols)*scale+0.5), int(float64(rows)*scale+0.5))
+	if sz.X < 1 {
+		sz.X = 1
+	}
+	if sz.Y < 1 {
+		sz.Y = 1
+	}
+	small := gocv.NewMat()
+	defer small.Close()
+	gocv.Resize(img, &small, sz, 0, 0, gocv.InterpolationArea)
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, small)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
+
+// Thumbnail returns the stored JPEG thumbnail for a frame. It returns
+// sql.ErrNoRows if no thumbnail was stored.
+func (h *PHasher) Thumbnail(key string, frame int) ([]byte, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var thumb []byte
+	err = db.QueryRow(lookupThumbnailQuery, h.normalizeKey(key), frame).Scan(&thumb)
+	return thumb, err
+}
@@ -0,0 +1,34 @@
+package phash
+
+import (
+	"fmt"
+	stdimage "image"
+
+	"gocv.io/x/gocv"
+)
+
+// tileVariants returns hashes of a Tiles x Tiles grid of overlapping tiles of
+// 'img'. Each tile spans two grid cells in each dimension, so adjacent tiles
+// overlap by half.
+func (h *PHasher) tileVariants(img gocv.Mat) []Variant {
+	n := h.Tiles
+	cols, rows := img.Cols(), img.Rows()
+	result := make([]Variant, 0, n*n)
+	for r := 0; r < n; r++ {
+		for c := 0; c < n; c++ {
+			rect := stdimage.Rect(
+				c*cols/(n+1), r*rows/(n+1),
+				(c+2)*cols/(n+1), (r+2)*rows/(n+1))
+			if rect.Empty() {
+				continue
+			}
+			tile := img.Region(rect)
+			result = append(result, Variant{
+				Name: fmt.Sprintf("tile-%d-%d", r, c),
+				Hash: h.hashMat(tile),
+			})
+			tile.Close()
+		}
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package phash
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// matchHeap is a max-heap of matches by distance, so the farthest of the
+// closest matches seen so far is at the root.
+type matchHeap []Match
+
+func (m matchHeap) Len() int            { return len(m) }
+func (m matchHeap) Less(i, j int) bool  { return m[i].Distance > m[j].Distance }
+func (m matchHeap) Swap(i, j int)       { m[i], m[j] = m[j], m[i] }
+func (m *matchHeap) Push(x interface{}) { *m = append(*m, x.(Match)) }
+func (m *matchHeap) Pop() interface{} {
+	old := *m
+	x := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return x
+}
+
+// TopK returns the 'k' stored frames closest to 'hash' by Hamming distance,
+// sorted by ascending distance, regardless of MaxDistance. Ties at the
+// cutoff are broken arbitrarily.
+func (h *PHasher) TopK(hash []byte, k int) ([]Match, error) {
+	if err := checkHashLen(hash); err != nil {
+		return nil, err
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	st, err := h.hashStore(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(st.tableQuery(scanAllHashesQuery))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	un := st.unpack(hash)
+	stored := make([]uint32, len(un))
+	best := make(matchHeap, 0, k)
+	for rows.Next() {
+		var m Match
+		if err := rows.Scan(append([]interface{}{&m.Key, &m.Frame}, wordDest(stored)...)...); err != nil {
+			return nil, err
+		}
+		m.Distance = wordDistance(un, stored)
+		if len(best) < k {
+			heap.Push(&best, m)
+		} else if m.Distance < best[0].Distance {
+			best[0] = m
+			heap.Fix(&best, 0)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	result := []Match(best)
+	sort.Slice(result, func(i, j int) bool { return result[i].Distance < result[j].Distance })
+	return result, nil
+}
@@ -0,0 +1,57 @@
+package phash
+
+import (
+	"log"
+	"math"
+)
+
+const countFramesQuery = "select count(*) from key_hashes where fullpath = ?"
+
+// FrameDiscrepancy describes a key whose stored frame count differs from
+// ExpectedFrames by more than FrameTolerance.
+type FrameDiscrepancy struct {
+	Key      string
+	Expected int
+	Stored   int
+}
+
+// ValidateFrames compares the number of frames stored for each key in
+// ExpectedFrames against the expected count and returns keys that deviate by
+// more than FrameTolerance.
+func (h *PHasher) ValidateFrames() ([]FrameDiscrepancy, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	stmt, err := db.Prepare(h.tableQuery(countFramesQuery))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var result []FrameDiscrepancy
+	for key, expected := range h.ExpectedFrames {
+		var stored int
+		if err := stmt.QueryRow(h.normalizeKey(key)).Scan(&stored); err != nil {
+			return nil, err
+		}
+		allowed := h.FrameTolerance * float64(expected)
+		if math.Abs(float64(stored-expected)) > allowed {
+			result = append(result, FrameDiscrepancy{Key: key, Expected: expected, Stored: stored})
+		}
+	}
+	return result, nil
+}
+
+// logFrameDiscrepancies runs ValidateFrames and logs any discrepancies.
+func (h *PHasher) logFrameDiscrepancies() {
+	discrepancies, err := h.ValidateFrames()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, d := range discrepancies {
+		log.Printf("key %q: expected %d frames, stored %d", d.Key, d.Expected, d.Stored)
+	}
+}
@@ -0,0 +1,29 @@
+package phash
+
+import "gocv.io/x/gocv"
+
+// createVariantsQuery creates the 'key_hash_variants' table used by InitDB.
+// Rows hold hashes of transformed copies of frames, tagged by variant name.
+const createVariantsQuery = "CREATE TABLE IF NOT EXISTS key_hash_variants(fullpath text, frame integer, variant text, h1 bigint, h2 bigint, h3 bigint, h4 bigint, UNIQUE(fullpath, frame, variant))"
+const insertVariantQuery = "INSERT INTO key_hash_variants(fullpath, frame, variant, h1, h2, h3, h4) values(?,?,?,?,?,?,?)"
+const lookupVariantsQuery = "select fullpath, frame from key_hash_variants where h1 = ? and h2 = ? and h3 = ? and h4 = ?"
+
+// orientationVariants returns hashes of the horizontally flipped and 180
+// degree rotated copies of 'img'.
+func (h *PHasher) orientationVariants(img gocv.Mat) []Variant {
+	flips := []struct {
+		name string
+		code int
+	}{
+		{"hflip", 1},
+		{"rot180", -1},
+	}
+	result := make([]Variant, 0, len(flips))
+	for _, f := range flips {
+		flipped := gocv.NewMat()
+		gocv.Flip(img, &flipped, f.code)
+		result = append(result, Variant{Name: f.name, Hash: h.hashMat(flipped)})
+		flipped.Close()
+	}
+	return result
+}
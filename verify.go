@@ -0,0 +1,94 @@
+package phash
+
+import "database/sql"
+
+const (
+	zeroHashesQuery      = "select ifnull(fullpath, ''), ifnull(frame, 0) from key_hashes where h1 = 0 and h2 = 0 and h3 = 0 and h4 = 0"
+	nullColumnsQuery     = "select count(*) from key_hashes where fullpath is null or frame is null or h1 is null or h2 is null or h3 is null or h4 is null"
+	duplicateFramesQuery = "select fullpath, frame from key_hashes where fullpath is not null and frame is not null group by fullpath, frame having count(*) > 1"
+)
+
+// FrameRef identifies a stored frame.
+type FrameRef struct {
+	Key   string
+	Frame int
+}
+
+// VerifyReport describes problems found by Verify.
+type VerifyReport struct {
+	// Integrity holds messages from SQLite's integrity check, if it failed.
+	Integrity []string
+	// ZeroHashes are frames with an all-zero hash. These match any other
+	// all-zero hash and usually indicate a failed decode.
+	ZeroHashes []FrameRef
+	// NullRows is the number of rows with a NULL key, frame, or hash word.
+	NullRows int
+	// DuplicateFrames are (key, frame) pairs stored more than once.
+	DuplicateFrames []FrameRef
+}
+
+// OK reports whether no problems were found.
+func (r VerifyReport) OK() bool {
+	return len(r.Integrity) == 0 && len(r.ZeroHashes) == 0 && r.NullRows == 0 && len(r.DuplicateFrames) == 0
+}
+
+// Verify checks the DB's integrity and the well-formedness of stored hashes.
+func (h *PHasher) Verify() (report VerifyReport, err error) {
+	db, err := h.openDB()
+	if err != nil {
+		return report, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			rows.Close()
+			return report, err
+		}
+		if msg != "ok" {
+			report.Integrity = append(report.Integrity, msg)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	st, err := h.hashStore(db)
+	if err != nil {
+		return report, err
+	}
+	if report.ZeroHashes, err = queryFrameRefs(db, st.tableQuery(zeroHashesQuery)); err != nil {
+		return report, err
+	}
+	if err := db.QueryRow(st.tableQuery(nullColumnsQuery)).Scan(&report.NullRows); err != nil {
+		return report, err
+	}
+	if report.DuplicateFrames, err = queryFrameRefs(db, h.tableQuery(duplicateFramesQuery)); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// queryFrameRefs returns the (key, frame) rows selected by 'query'.
+func queryFrameRefs(db *sql.DB, query string) ([]FrameRef, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []FrameRef
+	for rows.Next() {
+		var f FrameRef
+		if err := rows.Scan(&f.Key, &f.Frame); err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
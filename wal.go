@@ -0,0 +1,77 @@
+package phash
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// walStore is implemented by Stores whose write-ahead log can be truncated.
+type walStore interface {
+	CheckpointWAL() error
+}
+
+// CheckpointWAL checkpoints the DB's write-ahead log and truncates it, if
+// the DB is in WAL mode. It does nothing otherwise.
+func (s *SQLiteStore) CheckpointWAL() error {
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		return err
+	}
+	if !strings.EqualFold(mode, "wal") {
+		return nil
+	}
+	var busy, frames, checkpointed int
+	if err := s.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &frames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("WAL checkpoint blocked by readers; %d of %d frames checkpointed", checkpointed, frames)
+	}
+	return nil
+}
+
+// CheckpointWAL checkpoints the WAL of each opened shard.
+func (s *ShardedStore) CheckpointWAL() error {
+	s.mu.Lock()
+	shards := make([]*SQLiteStore, 0, len(s.shards))
+	for _, st := range s.shards {
+		shards = append(shards, st)
+	}
+	s.mu.Unlock()
+	for _, st := range shards {
+		if err := st.CheckpointWAL(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointWAL checkpoints the WAL of 'st' after every
+// WALCheckpointCommits commits or WALCheckpointInterval, whichever comes
+// first, so long store runs don't grow the WAL without bound.
+func (h *PHasher) checkpointWAL(st Store, stats *runStats) {
+	if h.WALCheckpointCommits <= 0 && h.WALCheckpointInterval <= 0 {
+		return
+	}
+	ws, ok := st.(walStore)
+	if !ok {
+		return
+	}
+	stats.mu.Lock()
+	stats.walCommits++
+	due := (h.WALCheckpointCommits > 0 && stats.walCommits >= h.WALCheckpointCommits) ||
+		(h.WALCheckpointInterval > 0 && time.Since(stats.walCheckpointed) >= h.WALCheckpointInterval)
+	if due {
+		stats.walCommits = 0
+		stats.walCheckpointed = time.Now()
+	}
+	stats.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := ws.CheckpointWAL(); err != nil {
+		log.Printf("WAL checkpoint: %v", err)
+	}
+}
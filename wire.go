@@ -0,0 +1,120 @@
+package phash
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// wireRecord is a line of the stream written by EmitHashesInDirs: either the
+// emitter's hash settings, which come first, or a hashed frame.
+type wireRecord struct {
+	Settings map[string]string `json:"settings,omitempty"`
+	Result   *Result           `json:"result,omitempty"`
+}
+
+// EmitHashesInDirs hashes images in 'paths' like StoreHashesFromDirs, but
+// writes the Results to 'w' as newline-delimited JSON instead of storing
+// them, so hashing and storing can run on different machines (see
+// IngestResults). No DB is used. The stream starts with a record of the hash
+// settings, which IngestResults checks against the DB.
+func (h *PHasher) EmitHashesInDirs(paths []string, w io.Writer) Summary {
+	if err := CheckHashSupport(); err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(wireRecord{Settings: h.hashSettings()}); err != nil {
+		log.Fatal(err)
+	}
+	return h.runPipeline(paths, func(dbC chan *image, wg *sync.WaitGroup, stats *runStats) {
+		defer wg.Done()
+		failed := false
+		for img := range dbC {
+			if failed {
+				continue
+			}
+			r := img.result()
+			if err := enc.Encode(wireRecord{Result: &r}); err != nil {
+				log.Print(err)
+				h.Stop()
+				failed = true
+				continue
+			}
+			atomic.AddInt64(&stats.stored, 1)
+		}
+	})
+}
+
+// IngestResults reads a stream written by EmitHashesInDirs from 'r' and
+// stores the Results in Store in batches of BatchSize, as a store run
+// would. The stream's hash settings must match the DB's, and are recorded
+// if the DB has none.
+func (h *PHasher) IngestResults(r io.Reader) (Summary, error) {
+	unlock, err := h.lockStore()
+	if err != nil {
+		return Summary{}, err
+	}
+	defer unlock()
+	st, release, err := h.openStore()
+	if err != nil {
+		return Summary{}, err
+	}
+	defer release()
+	if err := st.Init(); err != nil {
+		return Summary{}, err
+	}
+
+	stats := newRunStats()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var settings map[string]string
+	var results []Result
+	for line := 1; ; line++ {
+		var rec wireRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats.summary(), fmt.Errorf("record %d: %v", line, err)
+		}
+		switch {
+		case rec.Settings != nil:
+			if settings != nil {
+				return stats.summary(), fmt.Errorf("record %d: unexpected settings", line)
+			}
+			if err := checkStoredSettings(st, rec.Settings, true); err != nil {
+				return stats.summary(), err
+			}
+			settings = rec.Settings
+		case rec.Result != nil:
+			if settings == nil {
+				return stats.summary(), fmt.Errorf("record %d: missing settings", line)
+			}
+			if n, err := settingHashLen(settings); err != nil {
+				return stats.summary(), fmt.Errorf("record %d: %v", line, err)
+			} else if len(rec.Result.Hash) != n {
+				return stats.summary(), fmt.Errorf("record %d: expected %d-byte hash, got %d bytes", line, n, len(rec.Result.Hash))
+			}
+			atomic.AddInt64(&stats.files, 1)
+			results = append(results, *rec.Result)
+			if len(results) == h.batchSize() {
+				if !h.insertResults(st, results, stats) {
+					return stats.summary(), fmt.Errorf("record %d: commit failed", line)
+				}
+				results = nil
+			}
+		}
+	}
+	if len(results) > 0 && !h.insertResults(st, results, stats) {
+		return stats.summary(), fmt.Errorf("commit failed")
+	}
+	summary := stats.summary()
+	h.infof("summary: %v", summary)
+	return summary, nil
+}